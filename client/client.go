@@ -0,0 +1,212 @@
+package client
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * a client for the xBrowserSync API, for scripts and tools that want to talk
+ * to xSyn (or the official server, or anything else compatible) without
+ * hand-rolling the requests; each method mirrors one of the routes, eg.
+ *
+ *   c := client.New("https://xbs.example.com", nil)
+ *   sync, err := c.CreateSync(ctx, "1.5.2")
+ *
+ * when the server answers with one of its {code, message} error bodies, that
+ * comes back as an *Error, which can be checked against the Err* values here
+ * with errors.Is
+ *
+ * bookmarks are passed through as the encrypted strings the server stores;
+ * nothing here knows the password
+ *
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client talks to a single xBrowserSync server
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// New creates a client for the server at baseURL, including any path prefix it's mounted under;
+// requests go through httpClient, or http.DefaultClient if that's nil
+func New(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: httpClient,
+	}
+}
+
+// Sync is a newly created sync ID, as returned by CreateSync
+type Sync struct {
+	ID          string `json:"id"`
+	LastUpdated string `json:"lastUpdated"`
+	Version     string `json:"version"`
+}
+
+// Bookmarks is a sync ID's current, still encrypted, bookmarks data
+type Bookmarks struct {
+	Bookmarks   string `json:"bookmarks"`
+	LastUpdated string `json:"lastUpdated"`
+	Version     string `json:"version"`
+}
+
+// service status values reported by Info
+const (
+	StatusOnline     = 1
+	StatusOffline    = 2
+	StatusNoNewSyncs = 3
+)
+
+// Info describes the server, as returned by Info; Location is optional, and BuildStamp is
+// only reported by xSyn
+type Info struct {
+	Status      int    `json:"status"`
+	Message     string `json:"message"`
+	Version     string `json:"version"`
+	MaxSyncSize int64  `json:"maxSyncSize"`
+	Location    string `json:"location,omitempty"`
+	BuildStamp  string `json:"buildstamp,omitempty"`
+}
+
+// CreateSync asks for a new sync ID, with empty bookmarks; clientVersion is recorded
+// against it, and reported by Version
+func (c *Client) CreateSync(ctx context.Context, clientVersion string) (*Sync, error) {
+	return c.CreateSyncWithInvite(ctx, clientVersion, "")
+}
+
+// CreateSyncWithInvite is CreateSync for an invite-only xSyn server, handing over an invite
+// code; the server answers ErrInviteRequired or ErrInvalidInvite if it won't do
+func (c *Client) CreateSyncWithInvite(ctx context.Context, clientVersion, inviteCode string) (*Sync, error) {
+
+	request := struct {
+		Version    string `json:"version"`
+		InviteCode string `json:"inviteCode,omitempty"`
+	}{clientVersion, inviteCode}
+
+	var result Sync
+	if err := c.do(ctx, "POST", "/bookmarks", request, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetBookmarks fetches the bookmarks data for a sync ID
+func (c *Client) GetBookmarks(ctx context.Context, id string) (*Bookmarks, error) {
+
+	var result Bookmarks
+	if err := c.do(ctx, "GET", syncPath(id, ""), nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PutBookmarks replaces the bookmarks data for a sync ID, returning the new lastUpdated; pass
+// the lastUpdated last seen for the sync ID and the server will refuse with ErrSyncConflict if
+// someone else has synced in the meantime, or "" to overwrite regardless
+func (c *Client) PutBookmarks(ctx context.Context, id, bookmarks, lastUpdated string) (string, error) {
+
+	request := struct {
+		Bookmarks   string `json:"bookmarks"`
+		LastUpdated string `json:"lastUpdated,omitempty"`
+	}{bookmarks, lastUpdated}
+
+	var result struct {
+		LastUpdated string `json:"lastUpdated"`
+	}
+	if err := c.do(ctx, "PUT", syncPath(id, ""), request, &result); err != nil {
+		return "", err
+	}
+	return result.LastUpdated, nil
+}
+
+// LastUpdated fetches when a sync ID's bookmarks were last changed
+func (c *Client) LastUpdated(ctx context.Context, id string) (string, error) {
+
+	var result struct {
+		LastUpdated string `json:"lastUpdated"`
+	}
+	if err := c.do(ctx, "GET", syncPath(id, "/lastUpdated"), nil, &result); err != nil {
+		return "", err
+	}
+	return result.LastUpdated, nil
+}
+
+// Version fetches the version of the client that created a sync ID
+func (c *Client) Version(ctx context.Context, id string) (string, error) {
+
+	var result struct {
+		Version string `json:"version"`
+	}
+	if err := c.do(ctx, "GET", syncPath(id, "/version"), nil, &result); err != nil {
+		return "", err
+	}
+	return result.Version, nil
+}
+
+// Info fetches the server's status and limits
+func (c *Client) Info(ctx context.Context) (*Info, error) {
+
+	var result Info
+	if err := c.do(ctx, "GET", "/info", nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func syncPath(id, suffix string) string {
+	return "/bookmarks/" + url.PathEscape(id) + suffix
+}
+
+// do sends a request, with body encoded as JSON if it isn't nil, and decodes the response
+// into result; anything other than a 200 is turned into an *Error
+func (c *Client) do(ctx context.Context, method, path string, body interface{}, result interface{}) error {
+
+	var requestBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		requestBody = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, requestBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp.StatusCode, responseBody)
+	}
+
+	if err = json.Unmarshal(responseBody, result); err != nil {
+		return fmt.Errorf("%s %s: malformed response: %s", method, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package client
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * round trips through a real xSyn server on the in-memory store
+ *
+ */
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ishani/xSyn/server"
+	"github.com/ishani/xSyn/store"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+
+	srv, err := server.New(server.Config{
+		ServiceMessage:   "testing",
+		MaxSyncSizeBytes: 1024,
+		BuildStamp:       "test-build",
+	}, store.NewMemory(store.HistoryPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+
+	return New(ts.URL+"/", ts.Client())
+}
+
+func TestRoundTrip(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	info, err := c.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Status != StatusOnline || info.Message != "testing" || info.BuildStamp != "test-build" || info.MaxSyncSize != 1024 {
+		t.Fatalf("unexpected info %+v", info)
+	}
+
+	sync, err := c.CreateSync(ctx, "1.5.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sync.ID) != 32 || len(sync.LastUpdated) == 0 || sync.Version != "1.5.2" {
+		t.Fatalf("unexpected sync %+v", sync)
+	}
+
+	lastUpdated, err := c.PutBookmarks(ctx, sync.ID, "first", sync.LastUpdated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bookmarks, err := c.GetBookmarks(ctx, sync.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bookmarks.Bookmarks != "first" || bookmarks.LastUpdated != lastUpdated || bookmarks.Version != "1.5.2" {
+		t.Fatalf("unexpected bookmarks %+v", bookmarks)
+	}
+
+	if got, err := c.LastUpdated(ctx, sync.ID); err != nil || got != lastUpdated {
+		t.Fatalf("LastUpdated = %q, %v; want %q", got, err, lastUpdated)
+	}
+	if got, err := c.Version(ctx, sync.ID); err != nil || got != "1.5.2" {
+		t.Fatalf("Version = %q, %v; want 1.5.2", got, err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	sync, err := c.CreateSync(ctx, "1.5.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.PutBookmarks(ctx, sync.ID, "first", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		call   func() error
+		want   error
+		status int
+	}{
+		{"malformed id", func() error { _, err := c.GetBookmarks(ctx, "not-a-sync-id"); return err }, ErrInvalidSyncID, 401},
+		{"unknown id", func() error { _, err := c.Version(ctx, strings.Repeat("0", 32)); return err }, ErrInvalidSyncID, 401},
+		{"stale lastUpdated", func() error { _, err := c.PutBookmarks(ctx, sync.ID, "second", sync.LastUpdated); return err }, ErrSyncConflict, 409},
+		{"no bookmarks", func() error { _, err := c.PutBookmarks(ctx, sync.ID, "", ""); return err }, ErrRequiredDataNotFound, 400},
+		{"too large", func() error { _, err := c.PutBookmarks(ctx, sync.ID, strings.Repeat("x", 2048), ""); return err }, ErrSyncDataLimitExceeded, 413},
+	}
+
+	for _, tt := range tests {
+		err := tt.call()
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+			continue
+		}
+		var apiErr *Error
+		if !errors.As(err, &apiErr) || apiErr.Status != tt.status || len(apiErr.Message) == 0 {
+			t.Errorf("%s: unexpected error %#v", tt.name, err)
+		}
+	}
+}
+
+func TestNonAPIError(t *testing.T) {
+	err := responseError(502, []byte("<html>bad gateway</html>"))
+
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Status != 502 || len(apiErr.Code) != 0 {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if errors.Is(err, ErrUnspecified) {
+		t.Fatal("an error without a code shouldn't match any of the Err values")
+	}
+}
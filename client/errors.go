@@ -0,0 +1,84 @@
+package client
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * the errors a server can answer with; xBrowserSync servers send back a
+ * {code, message} body along with a matching HTTP status, where the code is
+ * the name of the exception the official server would throw
+ *
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// error codes the xBrowserSync API defines, as found in Error.Code
+const (
+	CodeInvalidSyncID         = "InvalidSyncIdException"
+	CodeNewSyncsForbidden     = "NewSyncsForbiddenException"
+	CodeNewSyncsLimitExceeded = "NewSyncsLimitExceededException"
+	CodeRequiredDataNotFound  = "RequiredDataNotFoundException"
+	CodeSyncConflict          = "SyncConflictException"
+	CodeSyncDataLimitExceeded = "SyncDataLimitExceededException"
+	CodeRequestThrottled      = "RequestThrottledException"
+	CodeUnspecifiedError      = "UnspecifiedException"
+)
+
+// error codes of xSyn's own, for invite-only servers
+const (
+	CodeInviteRequired = "InviteCodeRequiredException"
+	CodeInvalidInvite  = "InvalidInviteCodeException"
+)
+
+// Error is an error response from the server; Code is empty if the response didn't
+// carry one, as with a proxy in front of the server failing, say
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if len(e.Code) == 0 {
+		return fmt.Sprintf("%d %s", e.Status, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Is matches any *Error with the same code, so that errors.Is(err, client.ErrSyncConflict) works
+// whatever the message
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && len(t.Code) > 0 && t.Code == e.Code
+}
+
+// an error to compare against for each code, with errors.Is
+var (
+	ErrInvalidSyncID         = &Error{Code: CodeInvalidSyncID}
+	ErrNewSyncsForbidden     = &Error{Code: CodeNewSyncsForbidden}
+	ErrNewSyncsLimitExceeded = &Error{Code: CodeNewSyncsLimitExceeded}
+	ErrRequiredDataNotFound  = &Error{Code: CodeRequiredDataNotFound}
+	ErrSyncConflict          = &Error{Code: CodeSyncConflict}
+	ErrSyncDataLimitExceeded = &Error{Code: CodeSyncDataLimitExceeded}
+	ErrRequestThrottled      = &Error{Code: CodeRequestThrottled}
+	ErrUnspecified           = &Error{Code: CodeUnspecifiedError}
+	ErrInviteRequired        = &Error{Code: CodeInviteRequired}
+	ErrInvalidInvite         = &Error{Code: CodeInvalidInvite}
+)
+
+// responseError builds an *Error from a failed response, making the best of bodies that
+// aren't in the usual form
+func responseError(status int, body []byte) error {
+
+	var decoded struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &decoded); err != nil || len(decoded.Code) == 0 {
+		return &Error{Status: status, Message: http.StatusText(status)}
+	}
+
+	return &Error{Status: status, Code: decoded.Code, Message: decoded.Message}
+}
@@ -0,0 +1,281 @@
+package main
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * the binary does more than serve; given a subcommand it will poke at the
+ * configured database instead, so it can be looked after without starting
+ * the HTTP server (or writing any SQL). config is loaded as usual, so any
+ * flags go before the subcommand, eg.
+ *
+ *   xsyn -config=dev list
+ *
+ * anything that only looks opens the database read-only; with Bolt that still
+ * means waiting for the server to let go of the file, SQLite doesn't mind
+ *
+ */
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/ishani/xSyn/store"
+)
+
+// a subcommand, along with how many arguments it takes (or -1 if it parses its own
+// flags and checks them itself) and a line for the usage text
+type command struct {
+	name    string
+	args    string
+	argN    int
+	summary string
+	run     func(args []string) error
+}
+
+// commands are listed in the order they're shown in the usage text; running with no
+// subcommand at all is the same as 'serve', so existing deployments carry on as before
+var commands = []command{
+	{"serve", "", 0, "run the sync server (the default)", func(args []string) error { serve(); return nil }},
+	{"list", "", 0, "list every sync ID, with sizes and timestamps", runList},
+	{"show", "<id>", 1, "show the details and history of a sync ID", runShow},
+	{"delete", "<id>", 1, "delete a sync ID and its history", runDelete},
+	{"stats", "", 0, "show database statistics", runStats},
+	{"compact", "", 0, "rewrite the database file to reclaim free space (stop the server first)", runCompact},
+	{"restore", "[flags] <file>", -1, "restore sync IDs from a backup; 'restore -h' for the flags", runRestore},
+	{"export", "[-o file]", -1, "export every sync ID as JSON Lines", runExport},
+	{"import", "[flags] <file>", -1, "import sync IDs from an export; 'import -h' for the flags", runImport},
+	{"import-mongo", "[flags] <file>", -1, "import sync IDs from a mongoexport dump of an official xBrowserSync server", runImportMongo},
+	{"invites", "", 0, "list invite codes, with their uses and expiry", runInvites},
+	{"invite", "[flags]", -1, "create an invite code; 'invite -h' for the flags", runInvite},
+	{"uninvite", "<code>", 1, "delete an invite code", runUninvite},
+	{"decrypt", "-id <syncid> [flags]", -1, "decrypt a sync ID's bookmarks, given its password on stdin; 'decrypt -h' for the flags", runDecrypt},
+}
+
+// print the usage text, including the subcommands
+func commandUsage() {
+	out := flag.CommandLine.Output()
+
+	fmt.Fprintf(out, "usage: %s [flags] [command]\n\ncommands:\n", os.Args[0])
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.summary)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(out, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+// runCommand picks the subcommand out of the leftover command-line arguments and runs it
+func runCommand(args []string) error {
+
+	if len(args) == 0 {
+		serve()
+		return nil
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		if cmd.argN >= 0 && len(args)-1 != cmd.argN {
+			return fmt.Errorf("usage: %s %s", cmd.name, cmd.args)
+		}
+		return cmd.run(args[1:])
+	}
+
+	return fmt.Errorf("unknown command [%s]; run with -h for a list", args[0])
+}
+
+// open the configured store for one of the commands; the memory backend starts out empty
+// every time, so there's never anything to look at
+func openCommandStore(readOnly bool) (store.Store, error) {
+	if storeBackendName() == "memory" {
+		return nil, errors.New("the memory backend has no data outside of a running server")
+	}
+	return openStore(readOnly)
+}
+
+func runList(args []string) error {
+
+	syncStore, err := openCommandStore(true)
+	if err != nil {
+		return err
+	}
+	defer syncStore.Close()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSIZE\tLAST UPDATED\tLAST ACCESSED\tCREATED\tVERSION")
+
+	syncCount := 0
+	err = syncStore.Each(func(id string, record *store.SyncRecord) error {
+		syncCount++
+		_, err := fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n",
+			id, record.Size, record.LastUpdated, record.LastAccessed, record.Created, record.Version)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	tw.Flush()
+
+	fmt.Printf("\n%d sync IDs\n", syncCount)
+	return nil
+}
+
+func runShow(args []string) error {
+	markID := args[0]
+
+	syncStore, err := openCommandStore(true)
+	if err != nil {
+		return err
+	}
+	defer syncStore.Close()
+
+	// peek rather than get, so looking at an abandoned sync ID doesn't save it from pruning
+	record, err := syncStore.Peek(markID)
+	if err != nil {
+		return fmt.Errorf("%s: %s", markID, err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "id\t%s\n", markID)
+	fmt.Fprintf(tw, "version\t%s\n", record.Version)
+	fmt.Fprintf(tw, "size\t%d\n", record.Size)
+	fmt.Fprintf(tw, "created\t%s\n", record.Created)
+	fmt.Fprintf(tw, "last updated\t%s\n", record.LastUpdated)
+	fmt.Fprintf(tw, "last accessed\t%s\n", record.LastAccessed)
+	tw.Flush()
+
+	revisions, err := syncStore.History(markID)
+	if err != nil {
+		return err
+	}
+	if len(revisions) == 0 {
+		fmt.Println("\nno previous revisions")
+		return nil
+	}
+
+	fmt.Println()
+	tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "REVISION\tSIZE\tLAST UPDATED\tREPLACED")
+	for _, revision := range revisions {
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%s\n", revision.Revision, revision.Size, revision.LastUpdated, revision.Replaced)
+	}
+	return tw.Flush()
+}
+
+func runDelete(args []string) error {
+	markID := args[0]
+
+	syncStore, err := openCommandStore(false)
+	if err != nil {
+		return err
+	}
+	defer syncStore.Close()
+
+	if err = syncStore.Delete(markID); err != nil {
+		return fmt.Errorf("%s: %s", markID, err)
+	}
+
+	fmt.Printf("deleted %s\n", markID)
+	return nil
+}
+
+func runStats(args []string) error {
+
+	syncStore, err := openCommandStore(true)
+	if err != nil {
+		return err
+	}
+	defer syncStore.Close()
+
+	stats, err := syncStore.Stats()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "backend\t%s\n", storeBackendName())
+	fmt.Fprintf(tw, "file\t%s\n", storeFileName())
+	fmt.Fprintf(tw, "key count\t%d\n", stats.KeyCount)
+	fmt.Fprintf(tw, "db size (bytes)\t%d\n", stats.SizeBytes)
+	printStatDetails(tw, stats.Details)
+	return tw.Flush()
+}
+
+// write out the backend's detailed stats in a stable order; these come as groups of
+// name/value pairs, same as on the status page
+func printStatDetails(w io.Writer, details map[string]interface{}) {
+
+	groups := make([]string, 0, len(details))
+	for group := range details {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	for _, group := range groups {
+		fmt.Fprintf(w, "\n[%s]\t\n", group)
+
+		values, ok := details[group].(map[string]interface{})
+		if !ok {
+			fmt.Fprintf(w, "\t%v\n", details[group])
+			continue
+		}
+
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fmt.Fprintf(w, "%s\t%v\n", name, values[name])
+		}
+	}
+}
+
+func runCompact(args []string) error {
+
+	storeFile := storeFileName()
+	if len(storeFile) == 0 {
+		return fmt.Errorf("the %s backend has no file to compact", storeBackendName())
+	}
+
+	before, err := storeFileSize(storeFile)
+	if err != nil {
+		return err
+	}
+
+	if err = compactStore(); err != nil {
+		return err
+	}
+
+	after, err := storeFileSize(storeFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("compacted %s: %d -> %d bytes\n", storeFile, before, after)
+	return nil
+}
+
+// the size of the database on disk, including SQLite's write-ahead log if there is one
+func storeFileSize(storeFile string) (int64, error) {
+
+	info, err := os.Stat(storeFile)
+	if err != nil {
+		return 0, err
+	}
+
+	size := info.Size()
+	if walInfo, err := os.Stat(storeFile + "-wal"); err == nil {
+		size += walInfo.Size()
+	}
+	return size, nil
+}
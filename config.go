@@ -30,20 +30,78 @@ import (
 )
 
 type tomlConfig struct {
-	Server   tomlServer
-	Bolt     tomlBolt
-	Security tomlSecurity
+	Server       tomlServer
+	Storage      tomlStorage
+	Bolt         tomlBolt
+	SQLite       tomlSQLite
+	History      tomlHistory
+	Prune        tomlPrune
+	Backup       tomlBackup
+	Security     tomlSecurity
+	Admin        tomlAdmin
+	Metrics      tomlMetrics
+	Log          tomlLog
+	Registration tomlRegistration
+}
+type tomlStorage struct {
+	Backend string `toml:"backend" env:"XS_STORAGE_BACKEND"`
 }
 type tomlBolt struct {
 	StorageFile string `toml:"file" env:"XS_BOLT_FILE"`
 	InitTimeout int32  `toml:"init_timeout"`
 }
+type tomlSQLite struct {
+	StorageFile string `toml:"file" env:"XS_SQLITE_FILE"`
+	BusyTimeout int32  `toml:"busy_timeout"`
+}
 type tomlServer struct {
-	ReleaseMode    bool   `toml:"release_mode" env:"XS_SRV_RELEASE"`
-	ServiceMessage string `toml:"service_message" env:"XS_SRV_MESSAGE"`
-	MaxSyncSizeKb  int32  `toml:"max_sync_size_kb" env:"XS_SRV_MAXSYNC"`
-	Port           int32  `toml:"port" env:"XS_SRV_PORT"`
-	StatusRoute    string `toml:"status_route" env:"XS_SRV_STATUS"`
+	ReleaseMode     bool   `toml:"release_mode" env:"XS_SRV_RELEASE"`
+	ServiceMessage  string `toml:"service_message" env:"XS_SRV_MESSAGE"`
+	MaxSyncSizeKb   int32  `toml:"max_sync_size_kb" env:"XS_SRV_MAXSYNC"`
+	Port            int32  `toml:"port" env:"XS_SRV_PORT"`
+	StatusRoute     string `toml:"status_route" env:"XS_SRV_STATUS"`
+	Location        string `toml:"location" env:"XS_SRV_LOCATION"`
+	ShutdownTimeout int32  `toml:"shutdown_timeout" env:"XS_SRV_SHUTDOWN_TIMEOUT"`
+}
+type tomlHistory struct {
+	Revisions  int32 `toml:"revisions" env:"XS_HIST_REVISIONS"`
+	MaxAgeDays int32 `toml:"max_age_days" env:"XS_HIST_MAX_AGE"`
+}
+type tomlPrune struct {
+	InactiveDays  int32 `toml:"inactive_days" env:"XS_PRUNE_INACTIVE_DAYS"`
+	IntervalHours int32 `toml:"interval_hours" env:"XS_PRUNE_INTERVAL"`
+}
+type tomlBackup struct {
+	Dir           string `toml:"dir" env:"XS_BACKUP_DIR"`
+	IntervalHours int32  `toml:"interval_hours" env:"XS_BACKUP_INTERVAL"`
+	Keep          int32  `toml:"keep" env:"XS_BACKUP_KEEP"`
+	Compress      bool   `toml:"compress" env:"XS_BACKUP_COMPRESS"`
+}
+type tomlAdmin struct {
+	Token     string `toml:"token" env:"XS_ADMIN_TOKEN"`
+	TokenHash string `toml:"token_hash" env:"XS_ADMIN_TOKEN_HASH"`
+}
+type tomlRegistration struct {
+	MaxSyncs         int32  `toml:"max_syncs" env:"XS_REG_MAX_SYNCS"`
+	MaxPerHour       int32  `toml:"max_per_hour" env:"XS_REG_MAX_PER_HOUR"`
+	MaxPerDay        int32  `toml:"max_per_day" env:"XS_REG_MAX_PER_DAY"`
+	OpenSchedule     string `toml:"open_schedule" env:"XS_REG_SCHEDULE"`
+	ScheduleTimezone string `toml:"schedule_timezone" env:"XS_REG_TIMEZONE"`
+	InviteOnly       bool   `toml:"invite_only" env:"XS_REG_INVITE_ONLY"`
+}
+type tomlLog struct {
+	Level      string `toml:"level" env:"XS_LOG_LEVEL"`
+	Format     string `toml:"format" env:"XS_LOG_FORMAT"`
+	File       string `toml:"file" env:"XS_LOG_FILE"`
+	MaxSizeMb  int32  `toml:"max_size_mb" env:"XS_LOG_MAX_SIZE"`
+	MaxBackups int32  `toml:"max_backups" env:"XS_LOG_MAX_BACKUPS"`
+	MaxAgeDays int32  `toml:"max_age_days" env:"XS_LOG_MAX_AGE"`
+	Compress   bool   `toml:"compress" env:"XS_LOG_COMPRESS"`
+	AccessLog  bool   `toml:"access_log" env:"XS_LOG_ACCESS"`
+}
+type tomlMetrics struct {
+	Route string `toml:"route" env:"XS_METRICS_ROUTE"`
+	Token string `toml:"token" env:"XS_METRICS_TOKEN"`
 }
 type tomlSecurity struct {
 	ReqPerSecond     float64 `toml:"max_requests_per_second" env:"XS_SEC_RPS"`
@@ -84,6 +142,9 @@ func LoadConfig() {
 		cfgLog.Panic("File not found")
 	}
 
+	// defaults for anything the file leaves out, where the zero value won't do
+	AppConfig.Security.AcceptNewSyncs = true
+
 	// parse and map the data onto the structs
 	if _, err := toml.Decode(string(cfgBytes), &AppConfig); err != nil {
 		cfgLog.Panic("Decode failure", zap.Error(err))
@@ -0,0 +1,266 @@
+package main
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * decrypting a sync ID's bookmarks, for someone who has lost every browser
+ * they synced from but still knows their sync ID and password; this is all
+ * done offline against the database, the server never sees a password
+ *
+ * since xBrowserSync 1.5 the clients encrypt like so -
+ *
+ *   key       = PBKDF2-SHA256(password, salt = sync ID, 250000 rounds, 32 bytes)
+ *   bookmarks = base64(iv[16] + AES-256-GCM(key, iv, LZUTF8(json)))
+ *
+ * and the JSON is a tree of bookmarks and folders under a few special
+ * "[xbs] ..." container folders, one for each part of the browser's UI
+ *
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	xbsKeyIterations = 250000
+	xbsKeyLength     = 32
+	xbsIVLength      = 16
+)
+
+// xbsBookmark is a bookmark, folder or separator as the clients encode them
+type xbsBookmark struct {
+	Title       string        `json:"title"`
+	URL         string        `json:"url"`
+	Description string        `json:"description"`
+	Tags        []string      `json:"tags"`
+	Children    []xbsBookmark `json:"children"`
+}
+
+// what the clients' container folders are called in a browser
+var xbsContainerTitles = map[string]string{
+	"[xbs] Menu":    "Bookmarks Menu",
+	"[xbs] Mobile":  "Mobile Bookmarks",
+	"[xbs] Other":   "Other Bookmarks",
+	"[xbs] Toolbar": "Bookmarks Toolbar",
+}
+
+// decryptBookmarks turns a sync ID's stored bookmarks back into the JSON the client started with
+func decryptBookmarks(syncID, password, encrypted string) ([]byte, error) {
+
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("bookmarks aren't base64: %s", err)
+	}
+	if len(data) <= xbsIVLength {
+		return nil, errors.New("bookmarks are too short to be encrypted data")
+	}
+
+	key := pbkdf2.Key([]byte(password), []byte(syncID), xbsKeyIterations, xbsKeyLength, sha256.New)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, xbsIVLength)
+	if err != nil {
+		return nil, err
+	}
+
+	// GCM authenticates as well as decrypts, so a wrong password is caught right here
+	compressed, err := gcm.Open(nil, data[:xbsIVLength], data[xbsIVLength:], nil)
+	if err != nil {
+		return nil, errors.New("decryption failed; wrong password, or synced by a client older than 1.5")
+	}
+
+	return decompressLZUTF8(compressed)
+}
+
+// isSeparator spots the clients' stand-in for a separator, a bookmark titled with a line of dashes
+func (b *xbsBookmark) isSeparator() bool {
+	return len(b.URL) == 0 && b.Children == nil && len(b.Title) > 0 && strings.Trim(b.Title, "-─") == ""
+}
+
+// countBookmarks counts the bookmarks in a tree, ignoring folders and separators
+func countBookmarks(bookmarks []xbsBookmark) int {
+	count := 0
+	for i := range bookmarks {
+		if len(bookmarks[i].URL) > 0 {
+			count++
+		}
+		count += countBookmarks(bookmarks[i].Children)
+	}
+	return count
+}
+
+// writeNetscapeBookmarks writes the tree out in the old Netscape bookmarks format, which
+// every browser can still import
+func writeNetscapeBookmarks(w io.Writer, bookmarks []xbsBookmark) error {
+
+	buffered := bufio.NewWriter(w)
+	buffered.WriteString(`<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<!-- This is an automatically generated file.
+     It will be read and overwritten.
+     DO NOT EDIT! -->
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+<DL><p>
+`)
+	writeNetscapeFolder(buffered, bookmarks, 1)
+	buffered.WriteString("</DL><p>\n")
+	return buffered.Flush()
+}
+
+func writeNetscapeFolder(w *bufio.Writer, bookmarks []xbsBookmark, depth int) {
+
+	indent := strings.Repeat("    ", depth)
+	for i := range bookmarks {
+		bookmark := &bookmarks[i]
+
+		switch {
+		case bookmark.isSeparator():
+			fmt.Fprintf(w, "%s<HR>\n", indent)
+
+		case len(bookmark.URL) == 0:
+			title := bookmark.Title
+			attributes := ""
+			if containerTitle, ok := xbsContainerTitles[title]; ok && depth == 1 {
+				title = containerTitle
+				if containerTitle == "Bookmarks Toolbar" {
+					attributes = ` PERSONAL_TOOLBAR_FOLDER="true"`
+				}
+			}
+			fmt.Fprintf(w, "%s<DT><H3%s>%s</H3>\n", indent, attributes, html.EscapeString(title))
+			fmt.Fprintf(w, "%s<DL><p>\n", indent)
+			writeNetscapeFolder(w, bookmark.Children, depth+1)
+			fmt.Fprintf(w, "%s</DL><p>\n", indent)
+
+		default:
+			attributes := ""
+			if len(bookmark.Tags) > 0 {
+				attributes = fmt.Sprintf(` TAGS="%s"`, html.EscapeString(strings.Join(bookmark.Tags, ",")))
+			}
+			fmt.Fprintf(w, "%s<DT><A HREF=\"%s\"%s>%s</A>\n", indent, html.EscapeString(bookmark.URL), attributes, html.EscapeString(bookmark.Title))
+			if len(bookmark.Description) > 0 {
+				fmt.Fprintf(w, "%s<DD>%s\n", indent, html.EscapeString(bookmark.Description))
+			}
+		}
+	}
+}
+
+// readPassword takes the first line of stdin as the password, prompting for it if that's a terminal
+func readPassword() (string, error) {
+
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "password: ")
+	}
+
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	// only the line ending is trimmed; spaces at either end could well be part of the password
+	password = strings.TrimRight(password, "\r\n")
+	if len(password) == 0 {
+		return "", errors.New("no password given on stdin")
+	}
+	return password, nil
+}
+
+func runDecrypt(args []string) error {
+
+	flags := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+	markID := flags.String("id", "", "the sync ID to decrypt")
+	revision := flags.Uint64("revision", 0, "decrypt this revision from the history, rather than the current bookmarks")
+	format := flags.String("format", "html", "html, for a Netscape bookmarks file any browser can import, or json as the client stores it")
+	outputFile := flags.String("o", "", "file to write to; the default is stdout")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if flags.NArg() != 0 || len(*markID) == 0 {
+		return errors.New("usage: decrypt -id <syncid> [flags] < password")
+	}
+	if *format != "html" && *format != "json" {
+		return fmt.Errorf("unknown format [%s]; html or json", *format)
+	}
+
+	syncStore, err := openCommandStore(true)
+	if err != nil {
+		return err
+	}
+	defer syncStore.Close()
+
+	var encrypted, lastUpdated string
+	if *revision == 0 {
+		record, err := syncStore.Peek(*markID)
+		if err != nil {
+			return fmt.Errorf("%s: %s", *markID, err)
+		}
+		encrypted, lastUpdated = record.Bookmarks, record.LastUpdated
+	} else {
+		previous, err := syncStore.Revision(*markID, *revision)
+		if err != nil {
+			return fmt.Errorf("%s: %s", *markID, err)
+		}
+		encrypted, lastUpdated = previous.Bookmarks, previous.LastUpdated
+	}
+	if len(encrypted) == 0 {
+		return fmt.Errorf("%s: nothing has been synced yet", *markID)
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	decrypted, err := decryptBookmarks(*markID, password, encrypted)
+	if err != nil {
+		return fmt.Errorf("%s: %s", *markID, err)
+	}
+
+	var bookmarks []xbsBookmark
+	if err = json.Unmarshal(decrypted, &bookmarks); err != nil {
+		return fmt.Errorf("%s: decrypted bookmarks aren't in a format we recognise: %s", *markID, err)
+	}
+
+	var output bytes.Buffer
+	if *format == "json" {
+		if err = json.Indent(&output, decrypted, "", "  "); err != nil {
+			return err
+		}
+		output.WriteByte('\n')
+	} else {
+		if err = writeNetscapeBookmarks(&output, bookmarks); err != nil {
+			return err
+		}
+	}
+
+	if len(*outputFile) == 0 {
+		_, err = output.WriteTo(os.Stdout)
+	} else {
+		err = os.WriteFile(*outputFile, output.Bytes(), 0600)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "decrypted %d bookmarks, last updated %s\n", countBookmarks(bookmarks), lastUpdated)
+	return nil
+}
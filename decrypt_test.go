@@ -0,0 +1,83 @@
+package main
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * decrypting against a fixed payload, encrypted and LZUTF8 compressed the way
+ * the 1.5+ clients do it, so that a change to the key derivation, the cipher
+ * or the decompressor shows up as a failure here rather than as a user's
+ * unreadable bookmarks
+ *
+ */
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const (
+	testXbsSyncID   = "b7a2c1e04f8d4a6e9c3b5d7f1a2e4c6b"
+	testXbsPassword = "correct horse battery staple"
+
+	// iv 000102..0f, then the ciphertext and GCM tag
+	testXbsEncrypted = "AAECAwQFBgcICQoLDA0OD17TyECiYzR6CBDg2C2IPrmh/XUxGhY7xCuScQgZVi1YHiA6Ipjbv2Et95Dy477+zVuXO3wgqkK9Vb9EnHDpt/4NJUa2DP6sn7NNtJ2bOUaP3nEZ1LD8Qug8vjQVICjgpCqZU8aVcO49jsT4suPoxm7zY5VzIDg+5f95ggNs5ukbCJ+vywNz97gLP/hI2EOt23Hm3gXmKkZiPKXLuN3kwh4IgCFrWeWY+yGlCLs="
+
+	testXbsJSON = `[{"title":"[xbs] Toolbar","children":[` +
+		`{"title":"xSyn","url":"https://github.com/ishani/xSyn","tags":["sync","go"]},` +
+		`{"title":"xSyn issues","url":"https://github.com/ishani/xSyn/issues"},` +
+		`{"title":"Café — menu","url":"https://example.com/café/menu"}]}]`
+)
+
+func TestDecryptBookmarks(t *testing.T) {
+
+	decrypted, err := decryptBookmarks(testXbsSyncID, testXbsPassword, testXbsEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != testXbsJSON {
+		t.Fatalf("decrypted to %s", decrypted)
+	}
+
+	var bookmarks []xbsBookmark
+	if err = json.Unmarshal(decrypted, &bookmarks); err != nil {
+		t.Fatal(err)
+	}
+	if count := countBookmarks(bookmarks); count != 3 {
+		t.Fatalf("%d bookmarks, want 3", count)
+	}
+
+	var html strings.Builder
+	if err = writeNetscapeBookmarks(&html, bookmarks); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`<H3 PERSONAL_TOOLBAR_FOLDER="true">Bookmarks Toolbar</H3>`,
+		`<A HREF="https://github.com/ishani/xSyn" TAGS="sync,go">xSyn</A>`,
+		`>Café — menu</A>`,
+	} {
+		if !strings.Contains(html.String(), expected) {
+			t.Fatalf("html is missing %s", expected)
+		}
+	}
+}
+
+func TestDecryptBookmarksFailures(t *testing.T) {
+
+	tests := []struct {
+		name, syncID, password, encrypted string
+	}{
+		{"wrong password", testXbsSyncID, "Correct horse battery staple", testXbsEncrypted},
+		{"wrong sync ID", strings.Repeat("0", 32), testXbsPassword, testXbsEncrypted},
+		{"not base64", testXbsSyncID, testXbsPassword, "not base64!"},
+		{"too short", testXbsSyncID, testXbsPassword, testXbsEncrypted[:20]},
+		{"truncated", testXbsSyncID, testXbsPassword, testXbsEncrypted[:len(testXbsEncrypted)-8]},
+		{"pre 1.5 client", testXbsSyncID, testXbsPassword, "U2FsdGVkX1+3Yw9wDqFZtWcEqH5N0tJkRnJ6f1QwGJk="},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if decrypted, err := decryptBookmarks(test.syncID, test.password, test.encrypted); err == nil {
+				t.Fatalf("decrypted to %q", decrypted)
+			}
+		})
+	}
+}
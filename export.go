@@ -0,0 +1,193 @@
+package main
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * exporting every sync ID to a JSON Lines file, one record per line, and
+ * importing them again; the format doesn't depend on the storage backend,
+ * so as well as being easy to audit with everyday tools it's the way to move
+ * data between backends, eg.
+ *
+ *   XS_STORAGE_BACKEND=bolt   xsyn export -o syncs.jsonl
+ *   XS_STORAGE_BACKEND=sqlite xsyn import syncs.jsonl
+ *
+ * the bookmarks themselves are exported as-is, still encrypted by the browser
+ *
+ */
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ishani/xSyn/store"
+)
+
+// exportRecord is a single line of an export file
+type exportRecord struct {
+	ID string `json:"id"`
+	store.SyncRecord
+}
+
+func runExport(args []string) error {
+
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	outputFile := flags.String("o", "", "file to write to, gzipped if it ends in .gz; the default is stdout")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errors.New("usage: export [-o file]")
+	}
+
+	syncStore, err := openCommandStore(true)
+	if err != nil {
+		return err
+	}
+	defer syncStore.Close()
+
+	if len(*outputFile) == 0 {
+		_, err = writeExport(syncStore, os.Stdout)
+		return err
+	}
+
+	output, err := os.OpenFile(*outputFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	var writer io.Writer = output
+	var gzWriter *gzip.Writer
+	if strings.HasSuffix(*outputFile, ".gz") {
+		gzWriter = gzip.NewWriter(output)
+		writer = gzWriter
+	}
+
+	exported, err := writeExport(syncStore, writer)
+	if err == nil && gzWriter != nil {
+		err = gzWriter.Close()
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*outputFile)
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %d sync IDs to %s\n", exported, *outputFile)
+	return nil
+}
+
+// writeExport writes every record in the store to w, one per line
+func writeExport(syncStore store.Store, w io.Writer) (int, error) {
+
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	encoder.SetEscapeHTML(false)
+
+	exported := 0
+	err := syncStore.Each(func(id string, record *store.SyncRecord) error {
+		exported++
+		return encoder.Encode(exportRecord{ID: id, SyncRecord: *record})
+	})
+	if err != nil {
+		return exported, err
+	}
+	return exported, buffered.Flush()
+}
+
+// eachExportRecord reads an export file, gzipped or not, calling fn with each record;
+// any malformed line stops it in its tracks
+func eachExportRecord(fileName string, fn func(id string, record *store.SyncRecord) error) error {
+
+	input, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	reader := bufio.NewReader(input)
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer gzReader.Close()
+		reader = bufio.NewReader(gzReader)
+	}
+
+	// bookmarks can run to a few hundred kb on a single line
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var record exportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		if !store.IsValidSyncID(record.ID) {
+			return fmt.Errorf("line %d: [%s] is not a valid sync ID", line, record.ID)
+		}
+		if len(record.LastUpdated) == 0 {
+			return fmt.Errorf("line %d: no lastUpdated for %s", line, record.ID)
+		}
+
+		if err := fn(record.ID, &record.SyncRecord); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func runImport(args []string) error {
+
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	options := addMergeFlags(flags, "import")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: import [flags] <file>")
+	}
+	if err := options.check(); err != nil {
+		return err
+	}
+
+	importFile := flags.Arg(0)
+
+	// read it through once before touching the store, so a bad line doesn't leave us half-imported
+	recordCount := 0
+	err := eachExportRecord(importFile, func(id string, record *store.SyncRecord) error {
+		recordCount++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %s", importFile, err)
+	}
+	fmt.Printf("read %d sync IDs\n", recordCount)
+
+	syncStore, err := openCommandStore(options.dryRun)
+	if err != nil {
+		return err
+	}
+	defer syncStore.Close()
+
+	return mergeRecords(syncStore, func(fn func(id string, record *store.SyncRecord) error) error {
+		return eachExportRecord(importFile, fn)
+	}, options)
+}
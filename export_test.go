@@ -0,0 +1,146 @@
+package main
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * exporting to JSON Lines and importing again, which between them have to
+ * carry every record across unchanged, whichever backends are at each end
+ *
+ */
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ishani/xSyn/store"
+)
+
+// fillTestStore puts a few sync IDs in a store, in various states
+func fillTestStore(t *testing.T, syncStore store.Store) {
+	t.Helper()
+
+	records := map[string]store.SyncRecord{
+		"0123456789abcdef0123456789abcdef": {
+			Bookmarks:    "encrypted bookmarks",
+			LastUpdated:  "2020-03-01T12:34:56.789Z",
+			Version:      "1.5.2",
+			Created:      "2019-01-01T00:00:00.000Z",
+			LastAccessed: "2021-06-01T00:00:00.000Z",
+		},
+		"fedcba9876543210fedcba9876543210": {
+			Bookmarks:    `unusual characters: <>&"\ ☃`,
+			LastUpdated:  "2022-02-02T02:02:02.002Z",
+			Version:      "1.6.0",
+			Created:      "2022-01-01T00:00:00.000Z",
+			LastAccessed: "2022-02-02T02:02:02.002Z",
+		},
+	}
+	for id, record := range records {
+		if err := syncStore.PutRecord(id, &record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// and one straight from CreateSync, never written to
+	if _, _, err := syncStore.CreateSync("1.5.2"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// allRecords reads every record out of a store
+func allRecords(t *testing.T, syncStore store.Store) map[string]store.SyncRecord {
+	t.Helper()
+
+	records := make(map[string]store.SyncRecord)
+	err := syncStore.Each(func(id string, record *store.SyncRecord) error {
+		records[id] = *record
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestExportRoundTrip(t *testing.T) {
+
+	source := store.NewMemory(store.HistoryPolicy{})
+	fillTestStore(t, source)
+	expected := allRecords(t, source)
+
+	for _, compress := range []bool{false, true} {
+
+		exportFile := filepath.Join(t.TempDir(), "syncs.jsonl")
+		output, err := os.Create(exportFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gzWriter *gzip.Writer
+		var exported int
+		if compress {
+			gzWriter = gzip.NewWriter(output)
+			exported, err = writeExport(source, gzWriter)
+			if err == nil {
+				err = gzWriter.Close()
+			}
+		} else {
+			exported, err = writeExport(source, output)
+		}
+		output.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exported != len(expected) {
+			t.Fatalf("exported %d, want %d", exported, len(expected))
+		}
+
+		// into a different backend, to be sure nothing depends on the one it came from
+		dest, err := store.OpenBolt(filepath.Join(t.TempDir(), "marks.db"), time.Second, store.HistoryPolicy{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dest.Close()
+
+		options := &mergeOptions{source: "import", mode: "merge", prefer: "newer"}
+		err = mergeRecords(dest, func(fn func(id string, record *store.SyncRecord) error) error {
+			return eachExportRecord(exportFile, fn)
+		}, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		imported := allRecords(t, dest)
+		if len(imported) != len(expected) {
+			t.Fatalf("imported %d, want %d", len(imported), len(expected))
+		}
+		for id, record := range expected {
+			if imported[id] != record {
+				t.Fatalf("compressed %t: %s came back as %+v, want %+v", compress, id, imported[id], record)
+			}
+		}
+	}
+}
+
+func TestEachExportRecordMalformed(t *testing.T) {
+
+	valid := `{"id":"0123456789abcdef0123456789abcdef","bookmarks":"a","lastUpdated":"2020-03-01T12:34:56.789Z","version":"1.5.2"}`
+
+	for name, contents := range map[string]string{
+		"truncated line":   valid + "\n" + valid[:30] + "\n",
+		"invalid sync ID":  `{"id":"not a sync id","bookmarks":"a","lastUpdated":"2020-03-01T12:34:56.789Z"}` + "\n",
+		"no lastUpdated":   `{"id":"0123456789abcdef0123456789abcdef","bookmarks":"a"}` + "\n",
+		"wrong field type": `{"id":"0123456789abcdef0123456789abcdef","bookmarks":7,"lastUpdated":"2020-03-01T12:34:56.789Z"}` + "\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			exportFile := filepath.Join(t.TempDir(), "syncs.jsonl")
+			if err := os.WriteFile(exportFile, []byte(contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := eachExportRecord(exportFile, func(id string, record *store.SyncRecord) error { return nil }); err == nil {
+				t.Fatalf("read a malformed export")
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * importing from the official xBrowserSync server, which keeps everything in
+ * a MongoDB 'bookmarks' collection; a dump of that from mongoexport, eg.
+ *
+ *   mongoexport --db=xbrowsersync --collection=bookmarks --out=bookmarks.json
+ *
+ * can be fed to 'xsyn import-mongo' and each sync ID will be written into our
+ * store unchanged, so browsers only need pointing at the new service URL
+ *
+ * mongoexport writes one document per line by default, or an array with
+ * --jsonArray; we take either. values come out in MongoDB's extended JSON,
+ * so dates arrive wrapped up as {"$date": ...} in one of several forms
+ *
+ */
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ishani/xSyn/store"
+)
+
+// a document from the official server's bookmarks collection, as mongoexport writes it
+type mongoSyncDocument struct {
+	ID           json.RawMessage `json:"_id"`
+	Bookmarks    string          `json:"bookmarks"`
+	LastUpdated  json.RawMessage `json:"lastUpdated"`
+	LastAccessed json.RawMessage `json:"lastAccessed"`
+	Version      string          `json:"version"`
+}
+
+// the various ways extended JSON can wrap up a value; only one of these will be set
+type mongoExtendedValue struct {
+	Date   json.RawMessage `json:"$date"`
+	Long   string          `json:"$numberLong"`
+	OID    string          `json:"$oid"`
+	UUID   string          `json:"$uuid"`
+	Binary json.RawMessage `json:"$binary"`
+}
+
+// parseMongoID pulls a sync ID out of an _id; the official server stores these as plain
+// strings, but be lenient in case the dump was taken with a UUID representation set
+func parseMongoID(raw json.RawMessage) (string, error) {
+
+	var plain string
+	if err := json.Unmarshal(raw, &plain); err == nil {
+		return plain, nil
+	}
+
+	var value mongoExtendedValue
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", fmt.Errorf("unrecognised _id %s", raw)
+	}
+
+	switch {
+	case len(value.UUID) > 0:
+		return strings.Replace(value.UUID, "-", "", -1), nil
+
+	case len(value.Binary) > 0:
+		// canonical form is {"base64": ..., "subType": ...}, the older one {"$binary": <base64>, "$type": ...}
+		var binary struct {
+			Base64 string `json:"base64"`
+		}
+		if err := json.Unmarshal(value.Binary, &binary); err != nil {
+			if err = json.Unmarshal(value.Binary, &binary.Base64); err != nil {
+				return "", fmt.Errorf("unrecognised _id %s", raw)
+			}
+		}
+		idBytes, err := base64.StdEncoding.DecodeString(binary.Base64)
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(idBytes), nil
+
+	case len(value.OID) > 0:
+		// an ObjectId; never going to be a valid sync ID, but pass it on so it's reported as such
+		return value.OID, nil
+	}
+
+	return "", fmt.Errorf("unrecognised _id %s", raw)
+}
+
+// parseMongoDate turns an extended JSON date into one of our timestamps; that's either
+// {"$date": "<ISO-8601>"}, {"$date": <ms since epoch>} or {"$date": {"$numberLong": "<ms>"}},
+// and we'll also take a bare ISO-8601 string in case the dump went through other tools
+func parseMongoDate(raw json.RawMessage) (string, error) {
+
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", errors.New("missing date")
+	}
+
+	var dateString string
+	if err := json.Unmarshal(raw, &dateString); err != nil {
+
+		var value mongoExtendedValue
+		if err = json.Unmarshal(raw, &value); err != nil || len(value.Date) == 0 {
+			return "", fmt.Errorf("unrecognised date %s", raw)
+		}
+
+		var ms int64
+		var nested mongoExtendedValue
+		switch {
+		case json.Unmarshal(value.Date, &dateString) == nil:
+			// ISO-8601, handled below
+		case json.Unmarshal(value.Date, &ms) == nil:
+			return formatMongoMillis(ms), nil
+		case json.Unmarshal(value.Date, &nested) == nil && len(nested.Long) > 0:
+			if ms, err = strconv.ParseInt(nested.Long, 10, 64); err != nil {
+				return "", err
+			}
+			return formatMongoMillis(ms), nil
+		default:
+			return "", fmt.Errorf("unrecognised date %s", raw)
+		}
+	}
+
+	parsed, err := time.Parse(time.RFC3339Nano, dateString)
+	if err != nil {
+		return "", err
+	}
+	return parsed.UTC().Format(store.TimestampFormat), nil
+}
+
+func formatMongoMillis(ms int64) string {
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(store.TimestampFormat)
+}
+
+// eachMongoDocument decodes a mongoexport dump, in either of its layouts, calling fn with each document
+func eachMongoDocument(r io.Reader, fn func(index int, doc *mongoSyncDocument, err error) error) error {
+
+	reader := bufio.NewReader(r)
+
+	// skip to the first thing of interest to see if we have an array or a stream of documents
+	var first byte
+	for {
+		peeked, err := reader.Peek(1)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if first = peeked[0]; !strings.ContainsRune(" \t\r\n", rune(first)) {
+			break
+		}
+		reader.ReadByte()
+	}
+
+	decoder := json.NewDecoder(reader)
+
+	isArray := first == '['
+	if isArray {
+		if _, err := decoder.Token(); err != nil {
+			return err
+		}
+	}
+	for index := 0; ; index++ {
+
+		if isArray && !decoder.More() {
+			return nil
+		}
+
+		// a document that won't decode at all leaves the stream in an unknown state, so that
+		// has to stop the import; anything that decodes but doesn't make sense is passed on
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err == io.EOF && !isArray {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("document %d: %s", index+1, err)
+		}
+
+		var doc mongoSyncDocument
+		err := json.Unmarshal(raw, &doc)
+		if err = fn(index, &doc, err); err != nil {
+			return err
+		}
+	}
+}
+
+// convert a document into one of our records, complaining if anything needed is missing
+func mongoDocumentToRecord(doc *mongoSyncDocument) (string, *store.SyncRecord, error) {
+
+	id, err := parseMongoID(doc.ID)
+	if err != nil {
+		return "", nil, err
+	}
+	if !store.IsValidSyncID(id) {
+		return id, nil, fmt.Errorf("[%s] is not a valid sync ID", id)
+	}
+
+	lastUpdated, err := parseMongoDate(doc.LastUpdated)
+	if err != nil {
+		return id, nil, fmt.Errorf("lastUpdated: %s", err)
+	}
+
+	// the official server doesn't record when a sync was created, and lastAccessed is
+	// optional in older versions; lastUpdated is the best we have for either
+	lastAccessed, err := parseMongoDate(doc.LastAccessed)
+	if err != nil {
+		lastAccessed = lastUpdated
+	}
+
+	return id, &store.SyncRecord{
+		Bookmarks:    doc.Bookmarks,
+		LastUpdated:  lastUpdated,
+		Version:      doc.Version,
+		Created:      lastUpdated,
+		LastAccessed: lastAccessed,
+	}, nil
+}
+
+func runImportMongo(args []string) error {
+
+	flags := flag.NewFlagSet("import-mongo", flag.ContinueOnError)
+	overwrite := flags.Bool("overwrite", false, "replace sync IDs that already exist, rather than skipping them")
+	dryRun := flags.Bool("dry-run", false, "check the dump and report what would be imported without changing anything")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: import-mongo [flags] <file>")
+	}
+
+	dump, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer dump.Close()
+
+	syncStore, err := openCommandStore(*dryRun)
+	if err != nil {
+		return err
+	}
+	defer syncStore.Close()
+
+	var imported, existing, invalid int
+
+	err = eachMongoDocument(dump, func(index int, doc *mongoSyncDocument, err error) error {
+
+		var id string
+		var record *store.SyncRecord
+		if err == nil {
+			id, record, err = mongoDocumentToRecord(doc)
+		}
+		if err != nil {
+			fmt.Printf("skipping document %d: %s\n", index+1, err)
+			invalid++
+			return nil
+		}
+
+		if _, err = syncStore.Peek(id); err == nil {
+			if !*overwrite {
+				fmt.Printf("skipping %s; already exists\n", id)
+				existing++
+				return nil
+			}
+		} else if err != store.ErrSyncNotFound {
+			return err
+		}
+
+		imported++
+		if *dryRun {
+			return nil
+		}
+		return syncStore.PutRecord(id, record)
+	})
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		fmt.Print("dry run, nothing changed; would have ")
+	}
+	fmt.Printf("imported %d, skipped %d existing and %d invalid\n", imported, existing, invalid)
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * reading mongoexport dumps of the official server's bookmarks collection;
+ * the lines here are in the shapes mongoexport has written over the years,
+ * relaxed and canonical extended JSON and the older strict mode before those
+ *
+ */
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ishani/xSyn/store"
+)
+
+const testMongoID = "0123456789abcdef0123456789abcdef"
+
+func TestMongoDocumentToRecord(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		line         string
+		id           string
+		lastUpdated  string
+		lastAccessed string
+		err          string
+	}{
+		{
+			name:         "relaxed, $date as a string",
+			line:         `{"_id":"0123456789abcdef0123456789abcdef","bookmarks":"encrypted","version":"1.5.2","lastUpdated":{"$date":"2020-03-01T12:34:56.789Z"},"lastAccessed":{"$date":"2021-06-01T00:00:00Z"}}`,
+			id:           testMongoID,
+			lastUpdated:  "2020-03-01T12:34:56.789Z",
+			lastAccessed: "2021-06-01T00:00:00.000Z",
+		},
+		{
+			name:         "relaxed, $date with an offset",
+			line:         `{"_id":"0123456789abcdef0123456789abcdef","bookmarks":"encrypted","version":"1.5.2","lastUpdated":{"$date":"2020-03-01T13:34:56.789+01:00"},"lastAccessed":{"$date":"2020-03-01T13:34:56.789+01:00"}}`,
+			id:           testMongoID,
+			lastUpdated:  "2020-03-01T12:34:56.789Z",
+			lastAccessed: "2020-03-01T12:34:56.789Z",
+		},
+		{
+			name:         "canonical, $date as $numberLong",
+			line:         `{"_id":"0123456789abcdef0123456789abcdef","bookmarks":"encrypted","version":"1.5.2","lastUpdated":{"$date":{"$numberLong":"1583066096789"}},"lastAccessed":{"$date":{"$numberLong":"1583066096789"}}}`,
+			id:           testMongoID,
+			lastUpdated:  "2020-03-01T12:34:56.789Z",
+			lastAccessed: "2020-03-01T12:34:56.789Z",
+		},
+		{
+			name:         "legacy, $date as milliseconds",
+			line:         `{"_id":"0123456789abcdef0123456789abcdef","bookmarks":"encrypted","version":"1.4.0","lastUpdated":{"$date":1583066096789}}`,
+			id:           testMongoID,
+			lastUpdated:  "2020-03-01T12:34:56.789Z",
+			lastAccessed: "2020-03-01T12:34:56.789Z",
+		},
+		{
+			name:         "legacy, no lastAccessed",
+			line:         `{"_id":"0123456789abcdef0123456789abcdef","bookmarks":"encrypted","version":"1.4.0","lastUpdated":{"$date":"2018-11-05T09:00:00.000Z"}}`,
+			id:           testMongoID,
+			lastUpdated:  "2018-11-05T09:00:00.000Z",
+			lastAccessed: "2018-11-05T09:00:00.000Z",
+		},
+		{
+			name:         "bare date strings",
+			line:         `{"_id":"0123456789abcdef0123456789abcdef","bookmarks":"encrypted","version":"1.5.2","lastUpdated":"2020-03-01T12:34:56.789Z","lastAccessed":null}`,
+			id:           testMongoID,
+			lastUpdated:  "2020-03-01T12:34:56.789Z",
+			lastAccessed: "2020-03-01T12:34:56.789Z",
+		},
+		{
+			name:         "_id as $uuid",
+			line:         `{"_id":{"$uuid":"01234567-89ab-cdef-0123-456789abcdef"},"bookmarks":"encrypted","version":"1.5.2","lastUpdated":{"$date":"2020-03-01T12:34:56.789Z"}}`,
+			id:           testMongoID,
+			lastUpdated:  "2020-03-01T12:34:56.789Z",
+			lastAccessed: "2020-03-01T12:34:56.789Z",
+		},
+		{
+			name:         "_id as canonical $binary",
+			line:         `{"_id":{"$binary":{"base64":"ASNFZ4mrze8BI0VniavN7w==","subType":"04"}},"bookmarks":"encrypted","version":"1.5.2","lastUpdated":{"$date":"2020-03-01T12:34:56.789Z"}}`,
+			id:           testMongoID,
+			lastUpdated:  "2020-03-01T12:34:56.789Z",
+			lastAccessed: "2020-03-01T12:34:56.789Z",
+		},
+		{
+			name:         "_id as legacy $binary",
+			line:         `{"_id":{"$binary":"ASNFZ4mrze8BI0VniavN7w==","$type":"04"},"bookmarks":"encrypted","version":"1.5.2","lastUpdated":{"$date":"2020-03-01T12:34:56.789Z"}}`,
+			id:           testMongoID,
+			lastUpdated:  "2020-03-01T12:34:56.789Z",
+			lastAccessed: "2020-03-01T12:34:56.789Z",
+		},
+		{
+			name: "_id as $oid",
+			line: `{"_id":{"$oid":"5e5b8f1c9d1e8a3f4c2b1a0d"},"bookmarks":"encrypted","version":"1.5.2","lastUpdated":{"$date":"2020-03-01T12:34:56.789Z"}}`,
+			id:   "5e5b8f1c9d1e8a3f4c2b1a0d",
+			err:  "not a valid sync ID",
+		},
+		{
+			name: "_id as a number",
+			line: `{"_id":42,"bookmarks":"encrypted","version":"1.5.2","lastUpdated":{"$date":"2020-03-01T12:34:56.789Z"}}`,
+			err:  "unrecognised _id",
+		},
+		{
+			name: "no lastUpdated",
+			line: `{"_id":"0123456789abcdef0123456789abcdef","bookmarks":"encrypted","version":"1.5.2"}`,
+			id:   testMongoID,
+			err:  "lastUpdated: missing date",
+		},
+		{
+			name: "$date that isn't a date",
+			line: `{"_id":"0123456789abcdef0123456789abcdef","bookmarks":"encrypted","version":"1.5.2","lastUpdated":{"$date":"last tuesday"}}`,
+			id:   testMongoID,
+			err:  "lastUpdated",
+		},
+		{
+			name: "$numberLong that isn't a number",
+			line: `{"_id":"0123456789abcdef0123456789abcdef","bookmarks":"encrypted","version":"1.5.2","lastUpdated":{"$date":{"$numberLong":"soon"}}}`,
+			id:   testMongoID,
+			err:  "lastUpdated",
+		},
+		{
+			name: "some other wrapper",
+			line: `{"_id":"0123456789abcdef0123456789abcdef","bookmarks":"encrypted","version":"1.5.2","lastUpdated":{"$timestamp":{"t":1583066096,"i":1}}}`,
+			id:   testMongoID,
+			err:  "unrecognised date",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var id string
+			var record *store.SyncRecord
+			var recordErr error
+			err := eachMongoDocument(strings.NewReader(test.line+"\n"), func(index int, doc *mongoSyncDocument, err error) error {
+				if err == nil {
+					id, record, err = mongoDocumentToRecord(doc)
+				}
+				recordErr = err
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if id != test.id {
+				t.Fatalf("id is %q, want %q", id, test.id)
+			}
+			if len(test.err) > 0 {
+				if recordErr == nil || !strings.Contains(recordErr.Error(), test.err) {
+					t.Fatalf("error is %v, want one about %q", recordErr, test.err)
+				}
+				return
+			}
+			if recordErr != nil {
+				t.Fatal(recordErr)
+			}
+
+			if record.Bookmarks != "encrypted" || record.LastUpdated != test.lastUpdated || record.Created != test.lastUpdated ||
+				record.LastAccessed != test.lastAccessed || len(record.Version) == 0 {
+				t.Fatalf("unexpected record %+v", record)
+			}
+		})
+	}
+}
+
+func TestEachMongoDocument(t *testing.T) {
+
+	valid := `{"_id":"0123456789abcdef0123456789abcdef","bookmarks":"a","version":"1.5.2","lastUpdated":{"$date":"2020-03-01T12:34:56.789Z"}}`
+	wrongType := `{"_id":"fedcba9876543210fedcba9876543210","bookmarks":7,"lastUpdated":{"$date":"2020-03-01T12:34:56.789Z"}}`
+
+	tests := []struct {
+		name    string
+		dump    string
+		count   int // documents passed on, including those that didn't unmarshal
+		invalid int // of those, the ones that didn't
+		err     bool
+	}{
+		{name: "empty", dump: "", count: 0},
+		{name: "blank lines", dump: "\n\n  \n", count: 0},
+		{name: "lines", dump: valid + "\n" + valid + "\n", count: 2},
+		{name: "lines without a final newline", dump: valid + "\n" + valid, count: 2},
+		{name: "array", dump: "[" + valid + ",\n" + valid + "]", count: 2},
+		{name: "pretty array", dump: "\n[\n  " + valid + ",\n  " + valid + "\n]\n", count: 2},
+		{name: "empty array", dump: "[]", count: 0},
+		{name: "document of the wrong shape", dump: valid + "\n" + wrongType + "\n" + valid, count: 3, invalid: 1},
+		{name: "truncated line", dump: valid + "\n" + valid[:40], count: 1, err: true},
+		{name: "garbage line", dump: valid + "\nnot json at all\n" + valid, count: 1, err: true},
+		{name: "unterminated array", dump: "[" + valid + ",", count: 1, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			count, invalid := 0, 0
+			err := eachMongoDocument(strings.NewReader(test.dump), func(index int, doc *mongoSyncDocument, err error) error {
+				if index != count {
+					t.Fatalf("document index %d, want %d", index, count)
+				}
+				count++
+				if err != nil {
+					invalid++
+				}
+				return nil
+			})
+			if (err != nil) != test.err {
+				t.Fatalf("error is %v", err)
+			}
+			if count != test.count || invalid != test.invalid {
+				t.Fatalf("%d documents with %d invalid, want %d with %d", count, invalid, test.count, test.invalid)
+			}
+		})
+	}
+}
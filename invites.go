@@ -0,0 +1,123 @@
+package main
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * looking after invite codes from the command line; the same as the
+ * /admin/invites routes, for when the admin API isn't switched on. as with
+ * the other commands that write, a Bolt file has to be let go of by the
+ * server first, so against a running server the admin API is the way
+ *
+ */
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ishani/xSyn/store"
+)
+
+func runInvites(args []string) error {
+
+	syncStore, err := openCommandStore(true)
+	if err != nil {
+		return err
+	}
+	defer syncStore.Close()
+
+	invites, err := syncStore.Invites()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CODE\tUSES\tEXPIRES\tLAST USED\tSTATE\tNOTE")
+	for _, invite := range invites {
+
+		uses := fmt.Sprintf("%d", invite.Uses)
+		if invite.MaxUses > 0 {
+			uses = fmt.Sprintf("%d/%d", invite.Uses, invite.MaxUses)
+		}
+
+		state := "usable"
+		switch invite.Usable(now) {
+		case store.ErrInviteExpired:
+			state = "expired"
+		case store.ErrInviteUsedUp:
+			state = "used up"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			invite.Code, uses, orDash(invite.Expires), orDash(invite.LastUsed), state, invite.Note)
+	}
+	tw.Flush()
+
+	fmt.Printf("\n%d invite codes\n", len(invites))
+	return nil
+}
+
+// orDash fills in an empty column, so the table still lines up
+func orDash(value string) string {
+	if len(value) == 0 {
+		return "-"
+	}
+	return value
+}
+
+func runInvite(args []string) error {
+
+	flags := flag.NewFlagSet("invite", flag.ContinueOnError)
+	maxUses := flags.Int("uses", 1, "how many sync IDs the code can create; 0 for any number")
+	validDays := flags.Int("days", 7, "how many days until the code expires; 0 for never")
+	note := flags.String("note", "", "a note to keep with the code, eg. who it was for")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errors.New("usage: invite [-uses n] [-days n] [-note text]")
+	}
+	if *maxUses < 0 || *validDays < 0 {
+		return errors.New("-uses and -days can't be negative")
+	}
+
+	syncStore, err := openCommandStore(false)
+	if err != nil {
+		return err
+	}
+	defer syncStore.Close()
+
+	invite, err := store.NewInvite(*maxUses, time.Hour*24*time.Duration(*validDays), *note)
+	if err != nil {
+		return err
+	}
+	if err = syncStore.CreateInvite(invite); err != nil {
+		return err
+	}
+
+	fmt.Println(invite.Code)
+	return nil
+}
+
+func runUninvite(args []string) error {
+	code := store.NormalizeInviteCode(args[0])
+
+	syncStore, err := openCommandStore(false)
+	if err != nil {
+		return err
+	}
+	defer syncStore.Close()
+
+	if err = syncStore.DeleteInvite(code); err != nil {
+		return fmt.Errorf("%s: %s", code, err)
+	}
+
+	fmt.Printf("deleted %s\n", code)
+	return nil
+}
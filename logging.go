@@ -0,0 +1,64 @@
+package main
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * building the logger from the [log] config; until that's been read we log
+ * with zap's production defaults, so there's somewhere for config problems
+ * to go
+ *
+ * log files are rotated by lumberjack, which needs no help from logrotate
+ * and friends; just point it at a file and say how much to keep
+ *
+ */
+
+import (
+	"fmt"
+	"os"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// newLogger builds a logger as described by the [log] config
+func newLogger(config tomlLog) (*zap.Logger, error) {
+
+	level := zapcore.InfoLevel
+	if len(config.Level) > 0 {
+		if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+			return nil, fmt.Errorf("log level [%s]; debug, info, warn or error", config.Level)
+		}
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	var encoder zapcore.Encoder
+	switch config.Format {
+	case "", "json":
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	case "console":
+		encoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	default:
+		return nil, fmt.Errorf("log format [%s]; json or console", config.Format)
+	}
+
+	var output zapcore.WriteSyncer
+	if len(config.File) == 0 {
+		output = zapcore.Lock(os.Stderr)
+	} else {
+		output = zapcore.AddSync(&lumberjack.Logger{
+			Filename:   config.File,
+			MaxSize:    int(config.MaxSizeMb),
+			MaxBackups: int(config.MaxBackups),
+			MaxAge:     int(config.MaxAgeDays),
+			Compress:   config.Compress,
+		})
+	}
+
+	// unlike zap's production preset there's no sampling here, as that would
+	// drop access log lines from a busy server
+	core := zapcore.NewCore(encoder, output, level)
+	return zap.New(core, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel)), nil
+}
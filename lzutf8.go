@@ -0,0 +1,65 @@
+package main
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * a decompressor for LZUTF8, which the xBrowserSync clients use to squash
+ * their bookmarks JSON before encrypting it; see
+ * https://github.com/rotemdan/lzutf8.js
+ *
+ * the compressed stream is UTF-8 text with back-references mixed in; those
+ * look like the start of a multi-byte UTF-8 character, except that the next
+ * byte has its top bit clear, which a real continuation byte never does
+ *
+ *   110lllll 0ddddddd            - copy l bytes from d bytes back
+ *   111lllll 0ddddddd dddddddd   - the same, with a 15 bit distance
+ *
+ */
+
+import (
+	"errors"
+)
+
+var errBadLZUTF8 = errors.New("malformed LZUTF8 data")
+
+// decompressLZUTF8 expands an LZUTF8 compressed buffer back into the original UTF-8 text
+func decompressLZUTF8(input []byte) ([]byte, error) {
+
+	output := make([]byte, 0, len(input)*3)
+
+	for i := 0; i < len(input); i++ {
+
+		value := input[i]
+
+		// anything that isn't the lead byte of a 2 or 3 byte sequence goes straight through,
+		// as does a lead byte followed by a UTF-8 continuation byte
+		if value>>6 != 3 || i+1 >= len(input) || input[i+1]>>7 == 1 {
+			output = append(output, value)
+			continue
+		}
+
+		length := int(value & 31)
+		var distance int
+		if value>>5 == 6 {
+			distance = int(input[i+1])
+			i++
+		} else {
+			if i+2 >= len(input) {
+				return nil, errBadLZUTF8
+			}
+			distance = int(input[i+1])<<8 | int(input[i+2])
+			i += 2
+		}
+
+		start := len(output) - distance
+		if distance == 0 || start < 0 {
+			return nil, errBadLZUTF8
+		}
+
+		// byte by byte, as the match is allowed to run on into what it's producing
+		for j := 0; j < length; j++ {
+			output = append(output, output[start+j])
+		}
+	}
+
+	return output, nil
+}
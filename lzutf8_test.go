@@ -0,0 +1,65 @@
+package main
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * the LZUTF8 decompressor, against streams put together by hand; whatever
+ * the input, it has to either decompress or fail, never panic
+ *
+ */
+
+import (
+	"testing"
+)
+
+func TestDecompressLZUTF8(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		input    []byte
+		expected string
+	}{
+		{"empty", []byte{}, ""},
+		{"literal run", []byte("no references here"), "no references here"},
+		{"multi-byte literals", []byte("café — ünïcode"), "café — ünïcode"},
+		{"lead byte at the end", []byte{'a', 0xC3}, "a\xc3"},
+		{"short reference", []byte{'a', 'b', 'c', 'd', 0xC4, 4}, "abcdabcd"},
+		{"reference mid-stream", []byte{'x', 'y', 'z', 'w', '-', 0xC4, 5, '!'}, "xyzw-xyzw!"},
+		{"overlapping reference", []byte{'a', 0xCA, 1}, "aaaaaaaaaaa"},
+		{"overlapping pair", []byte{'a', 'b', 0xC7, 2}, "ababababa"},
+		{"long reference", append(append([]byte("0123"), make([]byte, 300)...), 0xE4, 0x01, 0x30), "0123" + string(make([]byte, 300)) + "0123"},
+		{"reference to a multi-byte character", []byte{'\xc3', '\xa9', '\xc3', '\xa9', 0xC4, 4}, "éééé"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output, err := decompressLZUTF8(test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(output) != test.expected {
+				t.Fatalf("decompressed to %q, want %q", output, test.expected)
+			}
+		})
+	}
+}
+
+func TestDecompressLZUTF8Malformed(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"reference before any output", []byte{0xC4, 1}},
+		{"reference past the start", []byte{'a', 'b', 0xC4, 3}},
+		{"zero distance", []byte{'a', 0xC4, 0}},
+		{"long reference past the start", []byte{'a', 0xE4, 0x01, 0x00}},
+		{"truncated long reference", []byte{'a', 'b', 0xE4, 0x00}},
+		{"long zero distance", []byte{'a', 0xE4, 0x00, 0x00}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if output, err := decompressLZUTF8(test.input); err != errBadLZUTF8 {
+				t.Fatalf("decompressed to %q, %v", output, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * merging records from elsewhere - a backup snapshot, an export file - into
+ * the store; anything new is added, and where both sides hold the same sync
+ * ID with different lastUpdated times that's reported as a conflict, with
+ * the newer one winning unless told otherwise. replacing goes one further
+ * and deletes whatever the incoming side doesn't have
+ *
+ */
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/ishani/xSyn/store"
+)
+
+// mergeOptions controls how incoming records are merged into the store
+type mergeOptions struct {
+	source string // what the incoming side is called in flags and reports, eg. "snapshot"
+	mode   string
+	prefer string
+	dryRun bool
+}
+
+// addMergeFlags sets up the flags that fill in a mergeOptions
+func addMergeFlags(flags *flag.FlagSet, source string) *mergeOptions {
+
+	options := mergeOptions{source: source}
+
+	flags.StringVar(&options.mode, "mode", "merge",
+		fmt.Sprintf("merge: add to the live sync IDs; replace: also delete live sync IDs that aren't in the %s", source))
+	flags.StringVar(&options.prefer, "prefer", "newer",
+		fmt.Sprintf("which side wins a conflict when merging; newer, %s or live", source))
+	flags.BoolVar(&options.dryRun, "dry-run", false, "report what would change without changing anything")
+
+	return &options
+}
+
+// check the flags made sense
+func (options *mergeOptions) check() error {
+
+	if options.mode != "merge" && options.mode != "replace" {
+		return fmt.Errorf("unknown mode [%s]", options.mode)
+	}
+	if options.prefer != "newer" && options.prefer != options.source && options.prefer != "live" {
+		return fmt.Errorf("unknown preference [%s]", options.prefer)
+	}
+
+	// replacing means the live store ends up matching the incoming side
+	if options.mode == "replace" {
+		options.prefer = options.source
+	}
+	return nil
+}
+
+// timestampAfter reports whether a is later than b; anything that won't parse counts as older
+// than anything that does, and two unparseable timestamps fall back to comparing the strings
+func timestampAfter(a, b string) bool {
+	aTime, errA := time.Parse(time.RFC3339Nano, a)
+	bTime, errB := time.Parse(time.RFC3339Nano, b)
+	switch {
+	case errA != nil && errB != nil:
+		return a > b
+	case errA != nil:
+		return false
+	case errB != nil:
+		return true
+	}
+	return aTime.After(bTime)
+}
+
+// mergeRecords merges every record that 'each' produces into the live store, printing
+// any conflicts and deletions as it goes and a summary at the end
+func mergeRecords(live store.Store, each func(fn func(id string, record *store.SyncRecord) error) error, options *mergeOptions) error {
+
+	var added, unchanged, merged, keptLive, deleted int
+	incoming := make(map[string]bool)
+
+	err := each(func(id string, record *store.SyncRecord) error {
+		incoming[id] = true
+
+		current, err := live.Peek(id)
+		if err == store.ErrSyncNotFound {
+			added++
+			if options.dryRun {
+				return nil
+			}
+			return live.PutRecord(id, record)
+		}
+		if err != nil {
+			return err
+		}
+
+		if store.TimestampsMatch(current.LastUpdated, record.LastUpdated) {
+			unchanged++
+			return nil
+		}
+
+		useIncoming := options.prefer == options.source ||
+			(options.prefer == "newer" && timestampAfter(record.LastUpdated, current.LastUpdated))
+
+		kept := "live"
+		if useIncoming {
+			kept = options.source
+		}
+		fmt.Printf("conflict %s: live %s, %s %s; keeping %s\n", id, current.LastUpdated, options.source, record.LastUpdated, kept)
+
+		if !useIncoming {
+			keptLive++
+			return nil
+		}
+		merged++
+		if options.dryRun {
+			return nil
+		}
+		return live.PutRecord(id, record)
+	})
+	if err != nil {
+		return err
+	}
+
+	if options.mode == "replace" {
+
+		var surplus []string
+		err = live.Each(func(id string, record *store.SyncRecord) error {
+			if !incoming[id] {
+				surplus = append(surplus, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range surplus {
+			fmt.Printf("deleting %s; not in %s\n", id, options.source)
+			deleted++
+			if options.dryRun {
+				continue
+			}
+			if err = live.Delete(id); err != nil {
+				return err
+			}
+		}
+	}
+
+	if options.dryRun {
+		fmt.Print("dry run, nothing changed; would have ")
+	}
+	fmt.Printf("added %d, replaced %d, kept %d live, left %d unchanged, deleted %d\n", added, merged, keptLive, unchanged, deleted)
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * merging incoming records into a live store, where both sides can hold
+ * the same sync ID
+ *
+ */
+
+import (
+	"testing"
+
+	"github.com/ishani/xSyn/store"
+)
+
+const (
+	testMergeOlder = "2020-01-01T00:00:00.000Z"
+	testMergeNewer = "2021-01-01T00:00:00.000Z"
+)
+
+func testMergeRecord(bookmarks, lastUpdated string) store.SyncRecord {
+	return store.SyncRecord{
+		Bookmarks:    bookmarks,
+		LastUpdated:  lastUpdated,
+		Version:      "1.5.2",
+		Created:      testMergeOlder,
+		LastAccessed: lastUpdated,
+	}
+}
+
+// testMerge merges the same incoming records into a fresh live store with the given options,
+// returning the live store afterwards
+func testMerge(t *testing.T, mode, prefer string, dryRun bool) store.Store {
+	t.Helper()
+
+	live := store.NewMemory(store.HistoryPolicy{Revisions: 5})
+	for id, record := range map[string]store.SyncRecord{
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa": testMergeRecord("live older", testMergeOlder),
+		"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb": testMergeRecord("live newer", testMergeNewer),
+		"cccccccccccccccccccccccccccccccc": testMergeRecord("live same", testMergeOlder),
+		"dddddddddddddddddddddddddddddddd": testMergeRecord("live only", testMergeOlder),
+	} {
+		if err := live.PutRecord(id, &record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	incoming := map[string]store.SyncRecord{
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa": testMergeRecord("incoming newer", testMergeNewer),
+		"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb": testMergeRecord("incoming older", testMergeOlder),
+		"cccccccccccccccccccccccccccccccc": testMergeRecord("incoming same", testMergeOlder),
+		"eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee": testMergeRecord("incoming only", testMergeOlder),
+	}
+
+	options := &mergeOptions{source: "import", mode: mode, prefer: prefer, dryRun: dryRun}
+	if err := options.check(); err != nil {
+		t.Fatal(err)
+	}
+	err := mergeRecords(live, func(fn func(id string, record *store.SyncRecord) error) error {
+		for id, record := range incoming {
+			if err := fn(id, &record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return live
+}
+
+// expectBookmarks checks what each sync ID holds after a merge; "" for one that shouldn't be there
+func expectBookmarks(t *testing.T, live store.Store, expected map[string]string) {
+	t.Helper()
+
+	for id, bookmarks := range expected {
+		record, err := live.Peek(id)
+		if len(bookmarks) == 0 {
+			if err != store.ErrSyncNotFound {
+				t.Fatalf("%s should be gone: %+v, %v", id, record, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", id, err)
+		}
+		if record.Bookmarks != bookmarks {
+			t.Fatalf("%s holds %q, want %q", id, record.Bookmarks, bookmarks)
+		}
+	}
+}
+
+func TestMergeNewerWins(t *testing.T) {
+
+	live := testMerge(t, "merge", "newer", false)
+	expectBookmarks(t, live, map[string]string{
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa": "incoming newer",
+		"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb": "live newer",
+		"cccccccccccccccccccccccccccccccc": "live same",
+		"dddddddddddddddddddddddddddddddd": "live only",
+		"eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee": "incoming only",
+	})
+
+	// what the incoming side replaced can still be rolled back to
+	revisions, err := live.History("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	if err != nil || len(revisions) != 1 {
+		t.Fatalf("history %+v, %v", revisions, err)
+	}
+	revision, err := live.Revision("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", revisions[0].Revision)
+	if err != nil || revision.Bookmarks != "live older" {
+		t.Fatalf("revision %+v, %v", revision, err)
+	}
+}
+
+func TestMergePreferences(t *testing.T) {
+
+	expectBookmarks(t, testMerge(t, "merge", "import", false), map[string]string{
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa": "incoming newer",
+		"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb": "incoming older",
+		"dddddddddddddddddddddddddddddddd": "live only",
+	})
+	expectBookmarks(t, testMerge(t, "merge", "live", false), map[string]string{
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa": "live older",
+		"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb": "live newer",
+		"eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee": "incoming only",
+	})
+
+	// replacing takes the incoming side every time, and drops what it doesn't have
+	expectBookmarks(t, testMerge(t, "replace", "newer", false), map[string]string{
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa": "incoming newer",
+		"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb": "incoming older",
+		"dddddddddddddddddddddddddddddddd": "",
+		"eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee": "incoming only",
+	})
+
+	// and a dry run changes nothing at all
+	expectBookmarks(t, testMerge(t, "replace", "newer", true), map[string]string{
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa": "live older",
+		"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb": "live newer",
+		"dddddddddddddddddddddddddddddddd": "live only",
+		"eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee": "",
+	})
+}
+
+func TestTimestampAfter(t *testing.T) {
+
+	tests := []struct {
+		a, b  string
+		after bool
+	}{
+		{testMergeNewer, testMergeOlder, true},
+		{testMergeOlder, testMergeNewer, false},
+		{testMergeOlder, testMergeOlder, false},
+		{"2021-01-01T01:00:00.000+01:00", "2020-12-31T23:59:59.999Z", true},
+		{testMergeOlder, "garbage", true},
+		{"garbage", testMergeOlder, false},
+		{"b garbage", "a garbage", true},
+	}
+	for _, test := range tests {
+		if after := timestampAfter(test.a, test.b); after != test.after {
+			t.Errorf("timestampAfter(%s, %s) is %t", test.a, test.b, after)
+		}
+	}
+}
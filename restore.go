@@ -0,0 +1,254 @@
+package main
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * restoring from the backups in backup.go; a snapshot is checked against
+ * its manifest (if it still has one), copied somewhere safe, looked over
+ * read-only, opened as a store in its own right - which also upgrades
+ * snapshots taken by older builds - and then its records are merged into, or
+ * replace, the live ones
+ *
+ * where both sides hold the same sync ID with different lastUpdated times,
+ * that's reported as a conflict and by default the newer one wins; see merge.go
+ *
+ * invite codes the live store doesn't have are copied across too, but never
+ * replaced or deleted, as the live ones know best how often they've been used.
+ * server settings, like the accept_new_syncs toggle, are live state rather
+ * than data and aren't restored at all
+ *
+ */
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ishani/xSyn/store"
+)
+
+// hash a file the same way store.WriteBackup does
+func sha256File(fileName string) (string, error) {
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// copy a snapshot into the given file, unzipping it if needed; returns the backend the
+// snapshot came from, going by what the file looks like
+func unpackSnapshot(snapshotFile, destFile string) (string, error) {
+
+	src, err := os.Open(snapshotFile)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	var reader io.Reader = src
+
+	var magic [2]byte
+	if _, err = io.ReadFull(src, magic[:]); err != nil {
+		return "", fmt.Errorf("too short to be a snapshot")
+	}
+	if _, err = src.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if magic == [2]byte{0x1f, 0x8b} {
+		gzReader, err := gzip.NewReader(src)
+		if err != nil {
+			return "", err
+		}
+		defer gzReader.Close()
+		reader = gzReader
+	}
+
+	dest, err := os.OpenFile(destFile, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer dest.Close()
+
+	if _, err = io.Copy(dest, reader); err != nil {
+		return "", err
+	}
+
+	// every SQLite database starts with this; anything else had better be a Bolt file
+	header := make([]byte, 16)
+	if _, err = dest.ReadAt(header, 0); err == nil && bytes.Equal(header, []byte("SQLite format 3\x00")) {
+		return "sqlite", nil
+	}
+	return "bolt", nil
+}
+
+// openSnapshot checks a backup against its manifest, then opens a working copy of it as a store;
+// the copy is removed again by the returned cleanup function, which must be called when done
+func openSnapshot(snapshotFile string) (store.Store, *store.BackupManifest, func(), error) {
+
+	manifest, err := store.ReadBackupManifest(snapshotFile)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if manifest != nil {
+		checksum, err := sha256File(snapshotFile)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if checksum != manifest.SHA256 {
+			return nil, nil, nil, fmt.Errorf("checksum mismatch; manifest has %s, file is %s", manifest.SHA256, checksum)
+		}
+	}
+
+	tempDir, err := os.MkdirTemp("", "xsyn-restore")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(tempDir) }
+
+	workingFile := filepath.Join(tempDir, "snapshot")
+	backend, err := unpackSnapshot(snapshotFile, workingFile)
+	if err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+
+	// opening it read-write lets us migrate snapshots taken by older builds, but that would
+	// also quietly create whatever's missing; so it has to pass a read-only look first
+	if err = store.CheckSnapshot(backend, workingFile); err != nil {
+		cleanup()
+		return nil, nil, nil, fmt.Errorf("checking %s snapshot: %s", backend, err)
+	}
+
+	var snapshot store.Store
+	switch backend {
+	case "sqlite":
+		snapshot, err = store.OpenSQLite(workingFile, time.Second, store.HistoryPolicy{}, false)
+	default:
+		snapshot, err = store.OpenBolt(workingFile, time.Second, store.HistoryPolicy{}, false)
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, nil, fmt.Errorf("opening %s snapshot: %s", backend, err)
+	}
+
+	storeCleanup := func() {
+		snapshot.Close()
+		cleanup()
+	}
+
+	if manifest != nil {
+		keyCount := 0
+		err = snapshot.Each(func(id string, record *store.SyncRecord) error {
+			keyCount++
+			return nil
+		})
+		if err == nil && keyCount != manifest.KeyCount {
+			err = fmt.Errorf("manifest lists %d sync IDs, snapshot holds %d", manifest.KeyCount, keyCount)
+		}
+		if err != nil {
+			storeCleanup()
+			return nil, nil, nil, err
+		}
+	}
+
+	return snapshot, manifest, storeCleanup, nil
+}
+
+func runRestore(args []string) error {
+
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	options := addMergeFlags(flags, "snapshot")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: restore [flags] <file>")
+	}
+	if err := options.check(); err != nil {
+		return err
+	}
+
+	snapshot, manifest, cleanup, err := openSnapshot(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("%s: %s", flags.Arg(0), err)
+	}
+	defer cleanup()
+
+	if manifest != nil {
+		fmt.Printf("snapshot verified; %d sync IDs, taken %s\n", manifest.KeyCount, manifest.Created)
+	} else {
+		fmt.Println("no manifest found; the snapshot's checksum and contents can't be verified")
+	}
+
+	live, err := openCommandStore(options.dryRun)
+	if err != nil {
+		return err
+	}
+	defer live.Close()
+
+	if err = mergeRecords(live, snapshot.Each, options); err != nil {
+		return err
+	}
+	if err = restoreInvites(live, snapshot, options.dryRun); err != nil {
+		return err
+	}
+
+	fmt.Println("server settings aren't restored; the live ones, like accept_new_syncs, are kept")
+	return nil
+}
+
+// restoreInvites copies across the snapshot's invite codes that the live store doesn't have
+func restoreInvites(live, snapshot store.Store, dryRun bool) error {
+
+	invites, err := snapshot.Invites()
+	if err != nil {
+		return err
+	}
+	liveInvites, err := live.Invites()
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool, len(liveInvites))
+	for _, invite := range liveInvites {
+		existing[invite.Code] = true
+	}
+
+	added := 0
+	for i := range invites {
+		if existing[invites[i].Code] {
+			continue
+		}
+		added++
+		if dryRun {
+			continue
+		}
+		if err = live.CreateInvite(&invites[i]); err != nil {
+			return fmt.Errorf("invite %s: %s", invites[i].Code, err)
+		}
+	}
+
+	if dryRun {
+		fmt.Print("dry run; would have ")
+	}
+	fmt.Printf("added %d invite codes, %d already live\n", added, len(invites)-added)
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * restoring; the snapshot has to be checked before it's trusted, and invite
+ * codes come across along with the sync IDs
+ *
+ */
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ishani/xSyn/store"
+)
+
+// writeTestSnapshot backs up a Bolt store holding a sync ID and an invite code
+func writeTestSnapshot(t *testing.T, dir string, compress bool) (string, *store.Invite) {
+	t.Helper()
+
+	live, err := store.OpenBolt(filepath.Join(dir, "live.db"), time.Second, store.HistoryPolicy{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+
+	if _, _, err = live.CreateSync("1.5.2"); err != nil {
+		t.Fatal(err)
+	}
+	invite, err := store.NewInvite(2, 0, "restored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = live.CreateInvite(invite); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := store.WriteBackup(live, dir, compress, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, manifest.File), invite
+}
+
+func TestOpenSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	snapshotFile, _ := writeTestSnapshot(t, dir, true)
+
+	snapshot, manifest, cleanup, err := openSnapshot(snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if manifest == nil || manifest.KeyCount != 1 {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+	if stats, err := snapshot.Stats(); err != nil || stats.KeyCount != 1 {
+		t.Fatalf("snapshot stats %+v, %v", stats, err)
+	}
+}
+
+func TestOpenSnapshotTruncated(t *testing.T) {
+	dir := t.TempDir()
+	snapshotFile, _ := writeTestSnapshot(t, dir, false)
+
+	// without its manifest there's no checksum to catch it, only the snapshot check
+	data, err := os.ReadFile(snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncatedFile := filepath.Join(dir, "truncated.db")
+	if err = os.WriteFile(truncatedFile, data[:len(data)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if snapshot, _, cleanup, err := openSnapshot(truncatedFile); err == nil {
+		defer cleanup()
+		stats, _ := snapshot.Stats()
+		t.Fatalf("opened a truncated snapshot, holding %d sync IDs", stats.KeyCount)
+	}
+}
+
+func TestRestoreInvites(t *testing.T) {
+	dir := t.TempDir()
+	snapshotFile, invite := writeTestSnapshot(t, dir, false)
+
+	snapshot, _, cleanup, err := openSnapshot(snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	live := store.NewMemory(store.HistoryPolicy{})
+	if err = restoreInvites(live, snapshot, true); err != nil {
+		t.Fatal(err)
+	}
+	if invites, _ := live.Invites(); len(invites) != 0 {
+		t.Fatalf("dry run restored %d invites", len(invites))
+	}
+
+	if err = restoreInvites(live, snapshot, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = live.UseInvite(invite.Code); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second restore leaves the live invite, and the use it's had, alone
+	if err = restoreInvites(live, snapshot, false); err != nil {
+		t.Fatal(err)
+	}
+	invites, err := live.Invites()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invites) != 1 || invites[0].Uses != 1 || invites[0].Note != "restored" {
+		t.Fatalf("unexpected invites after restoring again %+v", invites)
+	}
+}
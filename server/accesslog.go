@@ -0,0 +1,69 @@
+package server
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * one structured log line per request, through the server's zap logger,
+ * in place of Gin's own plain text logger
+ *
+ * sync IDs are as good as passwords to the bookmarks (encrypted though they
+ * are) so they never go into the log whole; a few characters is enough to
+ * follow one sync ID through the log without handing it to whoever reads it
+ *
+ */
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/ishani/xSyn/store"
+)
+
+// routeName picks out the route a request matched, rather than its path, so that logs and
+// metrics aren't full of sync IDs; the status and toggle routes are meant to be hard to guess,
+// so they're given names instead, and anything that didn't match a route is lumped together
+func (s *Server) routeName(c *gin.Context) string {
+	route := c.FullPath()
+	switch {
+	case len(route) == 0:
+		return "unmatched"
+	case route == s.config.StatusRoute:
+		return "status_route"
+	case route == s.config.SyncToggleRoute:
+		return "sync_toggle_route"
+	}
+	return route
+}
+
+// accessLog logs each request once it's been handled; it goes in front of the rate limiter so
+// that requests it turns away are logged too
+func (s *Server) accessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		// Size is -1 until something's been written
+		bytes := c.Writer.Size()
+		if bytes < 0 {
+			bytes = 0
+		}
+
+		fields := []zap.Field{
+			zap.String("method", c.Request.Method),
+			zap.String("route", s.routeName(c)),
+			zap.Int("status", c.Writer.Status()),
+			zap.Duration("latency", time.Since(start)),
+			zap.Int("bytes", bytes),
+			zap.String("ip", c.ClientIP()),
+		}
+		if id := c.Param("id"); len(id) > 0 {
+			fields = append(fields, zap.String("syncId", store.RedactSyncID(id)))
+		}
+		if code := c.GetString(errorCodeKey); len(code) > 0 {
+			fields = append(fields, zap.String("code", code))
+		}
+
+		zLog.Info("Request", fields...)
+	}
+}
@@ -0,0 +1,272 @@
+package server
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * the admin routes, for looking after the server without poking at the
+ * database by hand; these all live under /admin and are only enabled if
+ * an admin token (or a bcrypt hash of one) is configured, which must then
+ * be supplied with each request as a bearer token, ie.
+ * "Authorization: Bearer <token>"
+ *
+ */
+
+import (
+	"crypto/subtle"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ishani/xSyn/store"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// adminAuth rejects any request that doesn't carry a bearer token matching either the plain
+// token or the bcrypt hash given; an empty token or hash is never matched
+func adminAuth(token, tokenHash string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		authHeader := c.GetHeader("Authorization")
+		if !strings.HasPrefix(authHeader, "Bearer ") {
+			handleError(c, codeUnauthorized, "", errors.New("no bearer token"))
+			return
+		}
+
+		supplied := strings.TrimPrefix(authHeader, "Bearer ")
+
+		tokenMatch := len(token) > 0 && subtle.ConstantTimeCompare([]byte(supplied), []byte(token)) == 1
+		hashMatch := len(tokenHash) > 0 && bcrypt.CompareHashAndPassword([]byte(tokenHash), []byte(supplied)) == nil
+
+		if !tokenMatch && !hashMatch {
+			handleError(c, codeUnauthorized, "", errors.New("bad bearer token"))
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// report an error coming back from the store, choosing an error code to suit
+func handleAdminError(c *gin.Context, err error) bool {
+	switch err {
+	case nil:
+		return false
+	case store.ErrSyncNotFound:
+		return handleError(c, codeSyncNotFound, "", err)
+	case store.ErrRevisionNotFound:
+		return handleError(c, codeRevisionNotFound, "", err)
+	case store.ErrNotSupported:
+		return handleError(c, codeNotImplemented, "", err)
+	case store.ErrInviteNotFound:
+		return handleError(c, codeInviteNotFound, "", err)
+	}
+	return handleError(c, codeUnspecifiedError, "", err)
+}
+
+// adminSync is what we report about each sync ID when listing them; never the bookmarks themselves
+type adminSync struct {
+	ID           string `json:"id"`
+	LastUpdated  string `json:"lastUpdated"`
+	Version      string `json:"version"`
+	Created      string `json:"created"`
+	LastAccessed string `json:"lastAccessed"`
+	Size         int    `json:"size"`
+}
+
+// AcceptNewSyncsData is sent to, and returned from, /admin/accept-new-syncs
+type AcceptNewSyncsData struct {
+	AcceptNewSyncs *bool `json:"acceptNewSyncs" binding:"required"`
+}
+
+// addAdminRoutes hangs all of the admin routes off the given (already authenticated) group
+func (s *Server) addAdminRoutes(admin *gin.RouterGroup) {
+
+	// list every sync ID we hold, with enough detail to spot the big or abandoned ones
+	admin.GET("/syncs", func(c *gin.Context) {
+
+		syncs := []adminSync{}
+		err := s.store.Each(func(id string, record *store.SyncRecord) error {
+			syncs = append(syncs, adminSync{
+				ID:           id,
+				LastUpdated:  record.LastUpdated,
+				Version:      record.Version,
+				Created:      record.Created,
+				LastAccessed: record.LastAccessed,
+				Size:         record.Size,
+			})
+			return nil
+		})
+		if handleAdminError(c, err) {
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"syncs": syncs,
+			"count": len(syncs),
+		})
+	})
+
+	// remove a sync ID for good, along with its history; there's no undo
+	admin.DELETE("/syncs/:id", func(c *gin.Context) {
+		markID := c.Param("id")
+
+		if handleAdminError(c, s.store.Delete(markID)) {
+			return
+		}
+
+		zLog.Info("Deleted sync ID", zap.String("key", store.RedactSyncID(markID)))
+
+		c.Status(204)
+	})
+
+	// query or set whether new sync IDs can be created; this is the same switch as the
+	// sync_toggle_route flips, but with an explicit value so repeating a request is harmless
+	admin.GET("/accept-new-syncs", func(c *gin.Context) {
+		c.JSON(200, gin.H{
+			"acceptNewSyncs": s.newSyncsAllowed.Load(),
+		})
+	})
+
+	admin.PUT("/accept-new-syncs", func(c *gin.Context) {
+
+		var acceptData AcceptNewSyncsData
+		if err := c.ShouldBindJSON(&acceptData); err != nil {
+			handleError(c, codeRequiredDataNotFound, "", err)
+			return
+		}
+
+		s.setNewSyncsAllowed(*acceptData.AcceptNewSyncs)
+
+		c.JSON(200, gin.H{
+			"acceptNewSyncs": *acceptData.AcceptNewSyncs,
+		})
+	})
+
+	// create, list and delete invite codes; over in invites.go
+	s.addInviteRoutes(admin)
+
+	// download a snapshot of the whole store, in the backend's own file format (gzipped, unless
+	// ?gzip=false); it can be dropped in place of the live database file to restore it. the
+	// snapshot is taken into a temporary file first, so we can send its checksum up front
+	admin.POST("/backup", func(c *gin.Context) {
+
+		compress, err := strconv.ParseBool(c.DefaultQuery("gzip", "true"))
+		if err != nil {
+			handleError(c, codeRequiredDataNotFound, "", err)
+			return
+		}
+
+		tempDir, err := os.MkdirTemp("", "xsyn-download")
+		if handleError(c, codeUnspecifiedError, "", err) {
+			return
+		}
+		defer os.RemoveAll(tempDir)
+
+		manifest, err := store.WriteBackup(s.store, tempDir, compress, s.config.BuildStamp)
+		if handleAdminError(c, err) {
+			return
+		}
+
+		zLog.Info("Backup downloaded",
+			zap.String("file", manifest.File),
+			zap.Int("keys", manifest.KeyCount),
+			zap.Int64("bytes", manifest.Size),
+		)
+
+		c.Header("X-Checksum-Sha256", manifest.SHA256)
+		c.Header("X-Key-Count", strconv.Itoa(manifest.KeyCount))
+		c.FileAttachment(filepath.Join(tempDir, manifest.File), manifest.File)
+	})
+
+	// take a backup into the backup directory right now, as the scheduled backups do
+	admin.POST("/backups", func(c *gin.Context) {
+
+		if s.backups == nil {
+			handleError(c, codeNotImplemented, "No backup directory is configured", errors.New("backups disabled"))
+			return
+		}
+
+		manifest, err := s.backups.backup()
+		if handleAdminError(c, err) {
+			return
+		}
+
+		c.JSON(200, manifest)
+	})
+
+	// the same as the status route's JSON, plus everything the store has to say about itself
+	admin.GET("/stats", func(c *gin.Context) {
+
+		report, stats := s.buildStatusReport()
+		if stats == nil {
+			handleError(c, codeUnspecifiedError, "", errors.New(report.StoreError))
+			return
+		}
+
+		c.JSON(200, struct {
+			*statusReport
+			Store map[string]interface{} `json:"store"`
+		}{
+			report,
+			stats.Details,
+		})
+	})
+
+	// list the previous revisions we're holding for a sync ID
+	admin.GET("/syncs/:id/history", func(c *gin.Context) {
+
+		revisions, err := s.store.History(c.Param("id"))
+		if handleAdminError(c, err) {
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"revisions": revisions,
+		})
+	})
+
+	// fetch one previous revision, bookmarks data and all
+	admin.GET("/syncs/:id/history/:revision", func(c *gin.Context) {
+
+		revision, err := strconv.ParseUint(c.Param("revision"), 10, 64)
+		if err != nil {
+			handleError(c, codeRevisionNotFound, "", err)
+			return
+		}
+
+		result, err := s.store.Revision(c.Param("id"), revision)
+		if handleAdminError(c, err) {
+			return
+		}
+
+		c.JSON(200, result)
+	})
+
+	// make a previous revision current again; clients will pick it up on their next sync
+	admin.POST("/syncs/:id/history/:revision/restore", func(c *gin.Context) {
+		markID := c.Param("id")
+
+		revision, err := strconv.ParseUint(c.Param("revision"), 10, 64)
+		if err != nil {
+			handleError(c, codeRevisionNotFound, "", err)
+			return
+		}
+
+		imprintTime, err := s.store.RollBack(markID, revision)
+		if handleAdminError(c, err) {
+			return
+		}
+
+		zLog.Info("Rolled back sync ID",
+			zap.String("key", store.RedactSyncID(markID)),
+			zap.Uint64("revision", revision),
+		)
+
+		c.JSON(200, gin.H{
+			"lastUpdated": imprintTime,
+		})
+	})
+}
@@ -0,0 +1,135 @@
+package server
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * this is where we keep track of how much of the official API we actually implement,
+ * along with the error codes and HTTP status values that the browser extensions
+ * expect to see when things go wrong
+ *
+ * https://github.com/xbrowsersync/api for the reference server
+ *
+ */
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// apiRevisions lists the xBrowserSync API releases whose route behaviour xSyn implements,
+// oldest first; when adding support for a newer release, append it here once the routes
+// match - /info advertises the last entry, so we never claim more than we do
+var apiRevisions = []struct {
+	version string
+	summary string
+}{
+	{"1.0.0", "create, get and put bookmarks; lastUpdated and version lookups"},
+	{"1.1.0", "/info reports status, message, version and maxSyncSize"},
+	{"1.1.3", "sync IDs validated, unknown IDs rejected with InvalidSyncIdException"},
+	{"1.1.13", "lastUpdated precondition on PUT, location reported by /info"},
+}
+
+// apiVersion returns the newest API version we fully implement
+func apiVersion() string {
+	return apiRevisions[len(apiRevisions)-1].version
+}
+
+// service status values reported in the /info response
+const (
+	serviceStatusOnline     = 1
+	serviceStatusOffline    = 2
+	serviceStatusNoNewSyncs = 3
+)
+
+// error codes returned in the 'code' field of a failed request; these are the
+// exception names that the official server uses and the clients switch on
+const (
+	codeInvalidSyncID         = "InvalidSyncIdException"
+	codeNewSyncsForbidden     = "NewSyncsForbiddenException"
+	codeNewSyncsLimitExceeded = "NewSyncsLimitExceededException"
+	codeRequiredDataNotFound  = "RequiredDataNotFoundException"
+	codeSyncConflict          = "SyncConflictException"
+	codeSyncDataLimitExceeded = "SyncDataLimitExceededException"
+	codeUnspecifiedError      = "UnspecifiedException"
+	codeRequestThrottled      = "RequestThrottledException"
+)
+
+// error codes of our own, used by the admin routes and for invite codes; these aren't part of the xbs API
+const (
+	codeUnauthorized     = "UnauthorizedException"
+	codeSyncNotFound     = "SyncNotFoundException"
+	codeRevisionNotFound = "RevisionNotFoundException"
+	codeNotImplemented   = "NotImplementedException"
+	codeInviteRequired   = "InviteCodeRequiredException"
+	codeInvalidInvite    = "InvalidInviteCodeException"
+	codeInviteNotFound   = "InviteNotFoundException"
+)
+
+// the HTTP status the official server pairs with each error code; anything
+// not listed here is reported as a 500
+var errorCodeStatus = map[string]int{
+	codeInvalidSyncID:         401,
+	codeNewSyncsForbidden:     405,
+	codeNewSyncsLimitExceeded: 406,
+	codeRequiredDataNotFound:  400,
+	codeSyncConflict:          409,
+	codeSyncDataLimitExceeded: 413,
+	codeRequestThrottled:      429,
+	codeUnauthorized:          401,
+	codeSyncNotFound:          404,
+	codeRevisionNotFound:      404,
+	codeNotImplemented:        501,
+	codeInviteRequired:        403,
+	codeInvalidInvite:         403,
+	codeInviteNotFound:        404,
+}
+
+// the default message sent alongside each error code, when the caller doesn't supply one
+var errorCodeMessage = map[string]string{
+	codeInvalidSyncID:         "Invalid sync ID",
+	codeNewSyncsForbidden:     "The service is not accepting new syncs",
+	codeNewSyncsLimitExceeded: "The limit on new syncs has been reached",
+	codeRequiredDataNotFound:  "Unable to find required data",
+	codeSyncConflict:          "A sync conflict was detected",
+	codeSyncDataLimitExceeded: "Sync data limit exceeded",
+	codeRequestThrottled:      "Too many requests",
+	codeUnauthorized:          "Missing or invalid admin token",
+	codeSyncNotFound:          "Sync ID not found",
+	codeRevisionNotFound:      "Revision not found",
+	codeNotImplemented:        "Not supported by this server's configuration",
+	codeInviteRequired:        "An invite code is needed to create a new sync on this service",
+	codeInvalidInvite:         "That invite code isn't valid",
+	codeInviteNotFound:        "Invite code not found",
+	codeUnspecifiedError:      "An unspecified error has occurred",
+}
+
+// where handleError leaves the error code in the context, for the access log
+const errorCodeKey = "xsyn.errorCode"
+
+// xbs expects a {code, message} body and a status code matching the error when things go wrong;
+// this is a simple wrapper to generate the appropriate response, log the underlying Go error and
+// return true if the route handler should abort
+func handleError(c *gin.Context, code, message string, err error) bool {
+	if err != nil {
+
+		if len(message) == 0 {
+			message = errorCodeMessage[code]
+		}
+		if len(message) == 0 {
+			message = err.Error()
+		}
+
+		status, ok := errorCodeStatus[code]
+		if !ok {
+			status = 500
+		}
+
+		c.Set(errorCodeKey, code)
+		c.AbortWithStatusJSON(status, gin.H{
+			"code":    code,
+			"message": message,
+		})
+		zLog.Warn(code, zap.Error(err))
+		return true
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package server
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * scheduled backups into a directory, which is kept trimmed to the most
+ * recent few; see store/backup.go for what goes into each one
+ *
+ */
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ishani/xSyn/store"
+	"go.uber.org/zap"
+)
+
+// backupScheduler takes a backup into a directory every so often, keeping the most recent few
+type backupScheduler struct {
+	store    store.Store
+	dir      string
+	interval time.Duration
+	keep     int
+	compress bool
+
+	// recorded in each manifest
+	buildStamp string
+
+	lock       sync.Mutex
+	lastRun    time.Time
+	lastBackup *store.BackupManifest
+	lastError  error
+}
+
+func newBackupScheduler(syncStore store.Store, dir string, interval time.Duration, keep int, compress bool, buildStamp string) *backupScheduler {
+	return &backupScheduler{
+		store:    syncStore,
+		dir:      dir,
+		interval: interval,
+		keep:     keep,
+		compress: compress,
+
+		buildStamp: buildStamp,
+	}
+}
+
+// run takes backups on each tick until the context is cancelled; unlike the pruner this doesn't
+// start with one, as a server being restarted repeatedly would otherwise churn through them
+func (b *backupScheduler) run(ctx context.Context) {
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.backup()
+		}
+	}
+}
+
+// backup takes one backup now and trims the old ones, logging and recording how it went
+func (b *backupScheduler) backup() (*store.BackupManifest, error) {
+
+	manifest, err := store.WriteBackup(b.store, b.dir, b.compress, b.buildStamp)
+
+	b.lock.Lock()
+	b.lastRun = time.Now().UTC()
+	b.lastError = err
+	if err == nil {
+		b.lastBackup = manifest
+	}
+	b.lock.Unlock()
+
+	if err != nil {
+		zLog.Error("Backup failed", zap.String("dir", b.dir), zap.Error(err))
+		return nil, err
+	}
+
+	zLog.Info("Backup written",
+		zap.String("file", manifest.File),
+		zap.Int("keys", manifest.KeyCount),
+		zap.Int64("bytes", manifest.Size),
+	)
+
+	removed, err := store.TrimBackups(b.dir, b.keep)
+	for _, name := range removed {
+		zLog.Info("Removed old backup", zap.String("file", name))
+	}
+	if err != nil {
+		zLog.Warn("Failed to remove old backups", zap.Error(err))
+	}
+
+	return manifest, nil
+}
+
+// backupSummary describes the scheduler's work so far, as reported by the admin API
+type backupSummary struct {
+	Dir        string                `json:"dir"`
+	Interval   string                `json:"interval"`
+	Keep       int                   `json:"keep"`
+	LastRun    *time.Time            `json:"lastRun"`
+	LastBackup *store.BackupManifest `json:"lastBackup"`
+	LastError  string                `json:"lastError,omitempty"`
+}
+
+func (b *backupScheduler) summary() backupSummary {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	result := backupSummary{
+		Dir:        b.dir,
+		Interval:   b.interval.String(),
+		Keep:       b.keep,
+		LastBackup: b.lastBackup,
+	}
+	if !b.lastRun.IsZero() {
+		lastRun := b.lastRun
+		result.LastRun = &lastRun
+	}
+	if b.lastError != nil {
+		result.LastError = b.lastError.Error()
+	}
+	return result
+}
+
+// stats returns the same summary, formatted for the status page
+func (b *backupScheduler) stats() map[string]interface{} {
+
+	summary := b.summary()
+
+	result := map[string]interface{}{
+		"interval":    summary.Interval,
+		"keep":        summary.Keep,
+		"last run":    "never",
+		"last backup": "none",
+	}
+	if summary.LastRun != nil {
+		result["last run"] = summary.LastRun.Format(time.RFC850)
+	}
+	if summary.LastBackup != nil {
+		result["last backup"] = summary.LastBackup.File
+	}
+	if len(summary.LastError) > 0 {
+		result["last error"] = summary.LastError
+	}
+	return result
+}
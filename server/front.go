@@ -1,4 +1,4 @@
-package main
+package server
 
 var frontpageHTML = `
 <!DOCTYPE html>
@@ -41,7 +41,7 @@ var frontpageHTML = `
         <div class="jumbotron shadow p-3 mb-5">
         <h1 class="display-4">xSyn</h1>
         <p class="lead">
-        A fast, compact and <i>Docker</i>able server for <a href="https://www.xbrowsersync.org/" target="_blank">xBrowserSync</a>, written in Go, backed by <a href="https://github.com/boltdb/bolt" target="_blank">BoltDB</a>
+        A fast, compact and <i>Docker</i>able server for <a href="https://www.xbrowsersync.org/" target="_blank">xBrowserSync</a>, written in Go, backed by <a href="https://github.com/etcd-io/bbolt" target="_blank">BoltDB</a>
         </p>
         <hr class="my-4">
         <p>Written by Harry Denholm, ishani.org 2018</p>
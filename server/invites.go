@@ -0,0 +1,169 @@
+package server
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * invite-only registration, for a semi-private server; with InviteOnly set,
+ * POST /bookmarks only creates a sync ID for a client that brings an invite
+ * code, either in the X-Invite-Code header or as 'inviteCode' alongside the
+ * client version in the body
+ *
+ * the browser extensions know nothing of invite codes, so on an invite-only
+ * server a sync ID is created with the code some other way (curl, or the
+ * client package) and then entered into the extension as an existing one
+ *
+ * codes are created, listed and deleted through the admin API or the command
+ * line, and live in the store along with how many times they've been used
+ *
+ */
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ishani/xSyn/store"
+	"go.uber.org/zap"
+)
+
+// the header a client can send an invite code in, instead of in the body
+const inviteCodeHeader = "X-Invite-Code"
+
+// the first group of an invite code is enough to tell which it was in the log, without
+// leaving a usable code there for anyone who can read it
+func redactInviteCode(code string) string {
+	if group, _, found := strings.Cut(code, "-"); found {
+		return group + "-..."
+	}
+	return store.RedactSyncID(code)
+}
+
+// the message to go with each reason an invite code can't be used
+var inviteErrorMessage = map[error]string{
+	store.ErrInviteNotFound: "That invite code isn't valid",
+	store.ErrInviteExpired:  "That invite code has expired",
+	store.ErrInviteUsedUp:   "That invite code has already been used",
+}
+
+// CreateInviteData is sent to POST /admin/invites; MaxUses of 0 allows any number of uses,
+// and ValidDays of 0 never expires
+type CreateInviteData struct {
+	MaxUses   int    `json:"maxUses"`
+	ValidDays int    `json:"validDays"`
+	Note      string `json:"note"`
+}
+
+// useInvite takes a use of the invite code the client sent, if invites are required, returning
+// the code so that the use can be handed back with releaseInvite if the sync ID isn't created
+// after all; it reports the error and returns false if the sync ID shouldn't be created
+func (s *Server) useInvite(c *gin.Context, bookmarkData *CreateBookmarkData) (string, bool) {
+
+	if !s.config.InviteOnly {
+		return "", true
+	}
+
+	code := c.GetHeader(inviteCodeHeader)
+	if len(code) == 0 {
+		code = bookmarkData.InviteCode
+	}
+	code = store.NormalizeInviteCode(strings.TrimSpace(code))
+
+	if len(code) == 0 {
+		s.metrics.newSyncRejected("invite")
+		handleError(c, codeInviteRequired, "", errors.New("no invite code"))
+		return "", false
+	}
+
+	invite, err := s.store.UseInvite(code)
+	if message, ok := inviteErrorMessage[err]; ok {
+		s.metrics.newSyncRejected("invite")
+		handleError(c, codeInvalidInvite, message, err)
+		return "", false
+	}
+	if handleError(c, codeUnspecifiedError, "", err) {
+		return "", false
+	}
+
+	zLog.Info("Invite code used",
+		zap.String("code", redactInviteCode(invite.Code)),
+		zap.Int("uses", invite.Uses),
+	)
+	return invite.Code, true
+}
+
+// releaseInvite hands back a use taken by useInvite; a no-op for an empty code, as useInvite
+// returns when invites aren't required. the client has already been told of the failure that
+// led here, so a failure to hand the use back is only logged
+func (s *Server) releaseInvite(code string) {
+
+	if len(code) == 0 {
+		return
+	}
+	if err := s.store.ReleaseInvite(code); err != nil {
+		zLog.Warn("Failed to hand back invite code use", zap.String("code", redactInviteCode(code)), zap.Error(err))
+		return
+	}
+	zLog.Info("Invite code use handed back", zap.String("code", redactInviteCode(code)))
+}
+
+// addInviteRoutes hangs the invite code routes off the admin group
+func (s *Server) addInviteRoutes(admin *gin.RouterGroup) {
+
+	// list every invite code, used up and expired ones included
+	admin.GET("/invites", func(c *gin.Context) {
+
+		invites, err := s.store.Invites()
+		if handleAdminError(c, err) {
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"invites":    invites,
+			"count":      len(invites),
+			"inviteOnly": s.config.InviteOnly,
+		})
+	})
+
+	// make a new invite code; the code itself is chosen for us, and returned with the rest
+	admin.POST("/invites", func(c *gin.Context) {
+
+		var inviteData CreateInviteData
+		if err := c.ShouldBindJSON(&inviteData); err != nil {
+			handleError(c, codeRequiredDataNotFound, "", err)
+			return
+		}
+		if inviteData.MaxUses < 0 || inviteData.ValidDays < 0 {
+			handleError(c, codeRequiredDataNotFound, "maxUses and validDays can't be negative", errors.New("negative invite limits"))
+			return
+		}
+
+		invite, err := store.NewInvite(inviteData.MaxUses, time.Hour*24*time.Duration(inviteData.ValidDays), inviteData.Note)
+		if handleAdminError(c, err) {
+			return
+		}
+		if handleAdminError(c, s.store.CreateInvite(invite)) {
+			return
+		}
+
+		zLog.Info("Created invite code",
+			zap.String("code", redactInviteCode(invite.Code)),
+			zap.Int("maxUses", invite.MaxUses),
+			zap.String("expires", invite.Expires),
+		)
+
+		c.JSON(201, invite)
+	})
+
+	// delete an invite code so it can't be used again
+	admin.DELETE("/invites/:code", func(c *gin.Context) {
+		code := store.NormalizeInviteCode(c.Param("code"))
+
+		if handleAdminError(c, s.store.DeleteInvite(code)) {
+			return
+		}
+
+		zLog.Info("Deleted invite code", zap.String("code", redactInviteCode(code)))
+
+		c.Status(204)
+	})
+}
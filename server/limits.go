@@ -0,0 +1,280 @@
+package server
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * closing registrations automatically, rather than by hand with the toggle;
+ * new syncs can be turned away once the store holds a certain number of
+ * sync IDs, once a certain number have been created in the current hour or
+ * day, or outside of a schedule of opening times
+ *
+ * the key count comes from the store's stats, which can mean walking the
+ * whole database, so it's only refreshed every so often and kept up to date
+ * in between by counting what we create; the hourly and daily counts are only
+ * kept in memory, so a restart gives a fresh allowance
+ *
+ * a sync being created holds a reservation under the limits until it's either
+ * in the store or has failed; those are counted separately from the key count,
+ * so that a recount of the store doesn't forget them, and each remembers the
+ * hour and day it was made in, so handing one back after either has rolled
+ * over doesn't eat into the new allowance
+ *
+ */
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ishani/xSyn/store"
+	"go.uber.org/zap"
+)
+
+// how often to recount the sync IDs in the store, for the capacity limit
+const keyCountRefresh = time.Minute
+
+// closedReason says why new syncs aren't being accepted; code is the error to answer POST
+// /bookmarks with, and name is a short label for metrics and the status JSON
+type closedReason struct {
+	code    string
+	name    string
+	message string
+}
+
+// the reason given when new syncs have been switched off, by config or by hand
+var closedByToggle = &closedReason{
+	code:    codeNewSyncsForbidden,
+	name:    "disabled",
+	message: errorCodeMessage[codeNewSyncsForbidden],
+}
+
+type newSyncLimits struct {
+	store    store.Store
+	maxSyncs int
+	perHour  int
+	perDay   int
+	schedule *openSchedule
+
+	lock        sync.Mutex
+	keyCount    int
+	keyCountAt  time.Time
+	recountFrom time.Time
+	reserved    int
+	hour        time.Time
+	hourCount   int
+	day         time.Time
+	dayCount    int
+}
+
+// newSyncLimitsFromConfig returns nil if none of the limits are set
+func newSyncLimitsFromConfig(config Config, syncStore store.Store) (*newSyncLimits, error) {
+
+	if config.MaxSyncs <= 0 && config.NewSyncsPerHour <= 0 && config.NewSyncsPerDay <= 0 && len(config.OpenSchedule) == 0 {
+		return nil, nil
+	}
+
+	limits := &newSyncLimits{
+		store:    syncStore,
+		maxSyncs: config.MaxSyncs,
+		perHour:  config.NewSyncsPerHour,
+		perDay:   config.NewSyncsPerDay,
+	}
+
+	if len(config.OpenSchedule) > 0 {
+		location := config.ScheduleLocation
+		if location == nil {
+			location = time.UTC
+		}
+		schedule, err := parseSchedule(config.OpenSchedule, location)
+		if err != nil {
+			return nil, fmt.Errorf("open schedule %s", err)
+		}
+		limits.schedule = schedule
+	}
+
+	return limits, nil
+}
+
+// syncReservation is a place under the limits, held by a sync while it's being created
+type syncReservation struct {
+	limits *newSyncLimits
+	hour   time.Time
+	day    time.Time
+}
+
+// check sees if a new sync can be created at the given time, returning why not if it can't
+func (l *newSyncLimits) check(now time.Time) *closedReason {
+	l.refreshKeyCount(now)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.checkLocked(now)
+}
+
+// reserve is check, but a successful one counts as a sync created until the reservation is
+// either confirmed or released
+func (l *newSyncLimits) reserve(now time.Time) (*syncReservation, *closedReason) {
+	l.refreshKeyCount(now)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if closed := l.checkLocked(now); closed != nil {
+		return nil, closed
+	}
+
+	l.reserved++
+	l.hourCount++
+	l.dayCount++
+	return &syncReservation{limits: l, hour: l.hour, day: l.day}, nil
+}
+
+// checkLocked does the work of check; the caller must hold the lock
+func (l *newSyncLimits) checkLocked(now time.Time) *closedReason {
+
+	if l.schedule != nil && !l.schedule.openAt(now) {
+		return &closedReason{
+			code:    codeNewSyncsForbidden,
+			name:    "schedule",
+			message: fmt.Sprintf("New syncs are only accepted at certain times; the next opening is %s", l.schedule.nextOpening(now).Format("Mon 15:04 MST")),
+		}
+	}
+
+	if l.maxSyncs > 0 {
+		if l.keyCount+l.reserved >= l.maxSyncs {
+			return &closedReason{
+				code:    codeNewSyncsLimitExceeded,
+				name:    "capacity",
+				message: fmt.Sprintf("This server has reached its limit of %d syncs", l.maxSyncs),
+			}
+		}
+	}
+
+	// roll over to a fresh allowance when the hour or day changes
+	utc := now.UTC()
+	if hour := utc.Truncate(time.Hour); !hour.Equal(l.hour) {
+		l.hour, l.hourCount = hour, 0
+	}
+	if day := time.Date(utc.Year(), utc.Month(), utc.Day(), 0, 0, 0, 0, time.UTC); !day.Equal(l.day) {
+		l.day, l.dayCount = day, 0
+	}
+
+	if l.perHour > 0 && l.hourCount >= l.perHour {
+		return &closedReason{
+			code:    codeNewSyncsLimitExceeded,
+			name:    "hourly",
+			message: fmt.Sprintf("New syncs are limited to %d an hour; try again after %s", l.perHour, l.hour.Add(time.Hour).Format("15:04 MST")),
+		}
+	}
+	if l.perDay > 0 && l.dayCount >= l.perDay {
+		return &closedReason{
+			code:    codeNewSyncsLimitExceeded,
+			name:    "daily",
+			message: fmt.Sprintf("New syncs are limited to %d a day; try again after %s", l.perDay, l.day.AddDate(0, 0, 1).Format("Mon 15:04 MST")),
+		}
+	}
+
+	return nil
+}
+
+// confirm settles a reservation once the sync is in the store, created being a time taken
+// after CreateSync returned; it counts towards capacity from then on, unless a recount that
+// started after that has already found it. safe to call on a nil *syncReservation, as handed
+// out when there aren't any limits
+func (r *syncReservation) confirm(created time.Time) {
+	if r == nil {
+		return
+	}
+	l := r.limits
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.reserved--
+	if !created.Before(l.recountFrom) {
+		l.keyCount++
+	}
+}
+
+// release hands back a reservation when the sync couldn't be created after all; the hourly
+// and daily counts only get their place back if they're still counting the same hour and day
+func (r *syncReservation) release() {
+	if r == nil {
+		return
+	}
+	l := r.limits
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.reserved--
+	if r.hour.Equal(l.hour) && l.hourCount > 0 {
+		l.hourCount--
+	}
+	if r.day.Equal(l.day) && l.dayCount > 0 {
+		l.dayCount--
+	}
+}
+
+// recount the store, if it's been long enough since the last time; if that fails we carry on
+// with the count we have, and try again later. syncs still being created aren't in the count,
+// they're added on as reserved
+//
+// counting can mean walking the whole database, so it's done outside the lock; keyCountAt is
+// moved on first, so that only one request does the counting while the rest carry on with the
+// old count, and recountFrom is when the count started, for confirm to tell which syncs it found
+func (l *newSyncLimits) refreshKeyCount(now time.Time) {
+
+	if l.maxSyncs <= 0 {
+		return
+	}
+
+	l.lock.Lock()
+	due := now.Sub(l.keyCountAt) >= keyCountRefresh
+	if due {
+		l.keyCountAt = now
+	}
+	l.lock.Unlock()
+	if !due {
+		return
+	}
+
+	stats, err := l.store.Stats()
+	if err != nil {
+		zLog.Warn("Store stats", zap.Error(err))
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// a slow count finishing after one that started later has nothing to add
+	if now.Before(l.recountFrom) {
+		return
+	}
+	l.keyCount = stats.KeyCount
+	l.recountFrom = now
+}
+
+// newSyncsClosed checks whether new syncs can be created right now, and if not, why not
+func (s *Server) newSyncsClosed() *closedReason {
+
+	if !s.newSyncsAllowed.Load() {
+		return closedByToggle
+	}
+	if s.limits != nil {
+		return s.limits.check(time.Now())
+	}
+	return nil
+}
+
+// reserveNewSync is newSyncsClosed for a sync about to be created; with a nil reason, it holds
+// a place under the limits, which must be confirmed or released once the sync is or isn't
+func (s *Server) reserveNewSync() (*syncReservation, *closedReason) {
+
+	if !s.newSyncsAllowed.Load() {
+		return nil, closedByToggle
+	}
+	if s.limits != nil {
+		return s.limits.reserve(time.Now())
+	}
+	return nil, nil
+}
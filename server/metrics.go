@@ -0,0 +1,198 @@
+package server
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * Prometheus metrics, served on the metrics route when one is configured;
+ * request counts and latencies come from a middleware in front of everything
+ * else, the handlers count the xbs-specific events themselves, and the store's
+ * numbers are fetched fresh on each scrape
+ *
+ * every server gets its own registry, so that several can live in the one
+ * process without treading on each other's counters
+ *
+ */
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ishani/xSyn/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+const metricsNamespace = "xsyn"
+
+// serverMetrics holds the collectors the server updates as it goes; all of the methods
+// are safe to call on a nil *serverMetrics, which is what we have when metrics are off
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+
+	syncsCreated      prometheus.Counter
+	bytesWritten      prometheus.Counter
+	newSyncsRejected  *prometheus.CounterVec
+	requestsThrottled prometheus.Counter
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Requests handled, by route, method and status.",
+		}, []string{"route", "method", "status"}),
+
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to handle requests, by route, method and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+
+		syncsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "syncs_created_total",
+			Help:      "New sync IDs created.",
+		}),
+		bytesWritten: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "sync_bytes_written_total",
+			Help:      "Bookmarks data accepted by PUT /bookmarks/:id, in bytes.",
+		}),
+		newSyncsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "new_syncs_rejected_total",
+			Help:      "Requests for a new sync ID turned away, by reason; disabled, schedule, capacity, hourly, daily or invite.",
+		}, []string{"reason"}),
+		requestsThrottled: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_throttled_total",
+			Help:      "Requests turned away by the rate limiter.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.syncsCreated,
+		m.bytesWritten,
+		m.newSyncsRejected,
+		m.requestsThrottled,
+
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "accepting_new_syncs",
+			Help:      "1 if new sync IDs can currently be created, otherwise 0.",
+		}, func() float64 {
+			if s.newSyncsClosed() == nil {
+				return 1
+			}
+			return 0
+		}),
+
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "build_info",
+			Help:        "Always 1; labelled with the build stamp and storage backend.",
+			ConstLabels: prometheus.Labels{"buildstamp": s.config.BuildStamp, "backend": s.store.Backend()},
+		}, func() float64 { return 1 }),
+
+		&storeCollector{store: s.store},
+
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// middleware counts and times every request, labelled by routeName; it goes in front of the
+// rate limiter so that requests it turns away are counted too
+func (m *serverMetrics) middleware(routeName func(c *gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		labels := prometheus.Labels{
+			"route":  routeName(c),
+			"method": c.Request.Method,
+			"status": strconv.Itoa(status),
+		}
+		m.requests.With(labels).Inc()
+		m.requestDuration.With(labels).Observe(time.Since(start).Seconds())
+
+		if status == 429 {
+			m.requestsThrottled.Inc()
+		}
+	}
+}
+
+// handler serves the registry in the Prometheus text format
+func (m *serverMetrics) handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+func (m *serverMetrics) syncCreated() {
+	if m != nil {
+		m.syncsCreated.Inc()
+	}
+}
+
+func (m *serverMetrics) syncWritten(bytes int) {
+	if m != nil {
+		m.bytesWritten.Add(float64(bytes))
+	}
+}
+
+func (m *serverMetrics) newSyncRejected(reason string) {
+	if m != nil {
+		m.newSyncsRejected.WithLabelValues(reason).Inc()
+	}
+}
+
+// storeCollector reports the store's stats at scrape time; which metrics there are depends
+// on the backend, so they aren't described up front, making this an unchecked collector
+type storeCollector struct {
+	store store.Store
+}
+
+func (sc *storeCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (sc *storeCollector) Collect(ch chan<- prometheus.Metric) {
+
+	stats, err := sc.store.Stats()
+	if err != nil {
+		zLog.Warn("Store stats", zap.Error(err))
+		return
+	}
+
+	gauge := func(name, help string, value float64) {
+		desc := prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "store", name), help, nil, nil)
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value)
+	}
+	gauge("keys", "Sync IDs in the store.", float64(stats.KeyCount))
+	gauge("size_bytes", "Size of the store.", float64(stats.SizeBytes))
+
+	// and whatever the backend has to offer, under its own name
+	backend := sc.store.Backend()
+	for name, value := range stats.Metrics {
+		valueType := prometheus.GaugeValue
+		if strings.HasSuffix(name, "_total") {
+			valueType = prometheus.CounterValue
+		}
+		desc := prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, backend, name), "From the "+backend+" backend's own stats.", nil, nil)
+		ch <- prometheus.MustNewConstMetric(desc, valueType, value)
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * the pruner runs in the background and deletes sync IDs that nobody has
+ * read from or written to in a long time, so that a public server doesn't
+ * accumulate abandoned bookmark data forever
+ *
+ */
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ishani/xSyn/store"
+	"go.uber.org/zap"
+)
+
+type pruner struct {
+	store    store.Store
+	ttl      time.Duration
+	interval time.Duration
+
+	// results of the runs so far, for the status page
+	lock         sync.Mutex
+	lastRun      time.Time
+	lastRemoved  int
+	totalRemoved int
+}
+
+func newPruner(syncStore store.Store, ttl, interval time.Duration) *pruner {
+	return &pruner{
+		store:    syncStore,
+		ttl:      ttl,
+		interval: interval,
+	}
+}
+
+// run prunes once straight away, then again every interval until the context is cancelled
+func (p *pruner) run(ctx context.Context) {
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		p.prune()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// prune finds and deletes all the inactive sync IDs, returning how many were removed
+func (p *pruner) prune() int {
+
+	cutoff := time.Now().Add(-p.ttl)
+
+	// gather the candidates first, as we can't delete while walking the store; each is checked
+	// again as it's deleted, in case a client turned up in between. the bookmarks data is
+	// dropped as we only want enough to log what went
+	type staleSync struct {
+		id     string
+		record store.SyncRecord
+	}
+	var stale []staleSync
+	err := p.store.Each(func(id string, record *store.SyncRecord) error {
+		if store.IsInactive(record, cutoff) {
+			record.Bookmarks = ""
+			stale = append(stale, staleSync{id, *record})
+		}
+		return nil
+	})
+	if err != nil {
+		zLog.Warn("Pruning failed", zap.Error(err))
+		return 0
+	}
+
+	removed := 0
+	for _, candidate := range stale {
+
+		// a sync ID that's already gone, or has been used since, isn't ours to count
+		deleted, err := p.store.DeleteIfInactive(candidate.id, cutoff)
+		if err == store.ErrSyncNotFound || (err == nil && !deleted) {
+			continue
+		}
+		if err != nil {
+			zLog.Warn("Failed to prune sync ID", zap.String("key", store.RedactSyncID(candidate.id)), zap.Error(err))
+			continue
+		}
+
+		zLog.Info("Pruned inactive sync ID",
+			zap.String("key", store.RedactSyncID(candidate.id)),
+			zap.String("lastUpdated", candidate.record.LastUpdated),
+			zap.String("lastAccessed", candidate.record.LastAccessed),
+			zap.Int("size", candidate.record.Size),
+		)
+		removed++
+	}
+
+	zLog.Info("Pruning complete", zap.Int("removed", removed))
+
+	p.lock.Lock()
+	p.lastRun = time.Now().UTC()
+	p.lastRemoved = removed
+	p.totalRemoved += removed
+	p.lock.Unlock()
+
+	return removed
+}
+
+// pruneSummary describes the pruner's work so far, as reported by the admin API
+type pruneSummary struct {
+	InactivityTTL string     `json:"inactivityTtl"`
+	LastRun       *time.Time `json:"lastRun"`
+	LastRemoved   int        `json:"lastRemoved"`
+	TotalRemoved  int        `json:"totalRemoved"`
+}
+
+func (p *pruner) summary() pruneSummary {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	result := pruneSummary{
+		InactivityTTL: p.ttl.String(),
+		LastRemoved:   p.lastRemoved,
+		TotalRemoved:  p.totalRemoved,
+	}
+	if !p.lastRun.IsZero() {
+		lastRun := p.lastRun
+		result.LastRun = &lastRun
+	}
+	return result
+}
+
+// stats returns the same summary, formatted for the status page
+func (p *pruner) stats() map[string]interface{} {
+
+	summary := p.summary()
+
+	result := map[string]interface{}{
+		"inactivity ttl":     summary.InactivityTTL,
+		"removed (last run)": summary.LastRemoved,
+		"removed (total)":    summary.TotalRemoved,
+		"last run":           "never",
+	}
+	if summary.LastRun != nil {
+		result["last run"] = summary.LastRun.Format(time.RFC850)
+	}
+	return result
+}
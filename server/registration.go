@@ -0,0 +1,99 @@
+package server
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * whether new sync IDs can be created - ie. new users for the service
+ *
+ * the config gives the starting point, and the toggle route or the admin API
+ * can switch it while running; a switch is kept in the store so it survives
+ * a restart or redeploy, but only until the config itself is changed, at
+ * which point the config is taken to be what's wanted
+ *
+ * handlers read the state all the time and in parallel, so it's an atomic;
+ * switching it also takes a lock, so that what ends up in the store is
+ * always the last switch made
+ *
+ */
+
+import (
+	"encoding/json"
+
+	"go.uber.org/zap"
+)
+
+// the store setting the switched state is kept under
+const acceptNewSyncsSetting = "accept_new_syncs"
+
+// acceptNewSyncsState is what's kept in the store; Configured is what the config said when
+// the switch was made, so we can tell if it's been changed since
+type acceptNewSyncsState struct {
+	AcceptNewSyncs bool `json:"acceptNewSyncs"`
+	Configured     bool `json:"configured"`
+}
+
+// loadNewSyncsAllowed picks the state to start with, from the config or the store
+func (s *Server) loadNewSyncsAllowed() error {
+
+	configured := !s.config.NoNewSyncs
+	s.newSyncsAllowed.Store(configured)
+
+	stored, err := s.store.Setting(acceptNewSyncsSetting)
+	if err != nil {
+		return err
+	}
+	if len(stored) == 0 {
+		return nil
+	}
+
+	var state acceptNewSyncsState
+	if err = json.Unmarshal([]byte(stored), &state); err != nil {
+		zLog.Warn("Ignoring unreadable accept_new_syncs setting", zap.Error(err))
+		return nil
+	}
+	if state.Configured != configured {
+		zLog.Info("Config changed since accept_new_syncs was last switched, using config", zap.Bool("value", configured))
+
+		// and forget the switch, or it would come back if the config were changed back again
+		return s.store.PutSetting(acceptNewSyncsSetting, "")
+	}
+
+	if state.AcceptNewSyncs != configured {
+		zLog.Info("Restored accept_new_syncs", zap.Bool("value", state.AcceptNewSyncs))
+	}
+	s.newSyncsAllowed.Store(state.AcceptNewSyncs)
+	return nil
+}
+
+// setNewSyncsAllowed switches new syncs on or off
+func (s *Server) setNewSyncsAllowed(allowed bool) {
+	s.newSyncsLock.Lock()
+	defer s.newSyncsLock.Unlock()
+
+	s.newSyncsAllowed.Store(allowed)
+	s.saveNewSyncsAllowed(allowed)
+}
+
+// toggleNewSyncsAllowed flips new syncs on or off, returning the new state
+func (s *Server) toggleNewSyncsAllowed() bool {
+	s.newSyncsLock.Lock()
+	defer s.newSyncsLock.Unlock()
+
+	allowed := !s.newSyncsAllowed.Load()
+	s.newSyncsAllowed.Store(allowed)
+	s.saveNewSyncsAllowed(allowed)
+	return allowed
+}
+
+// keep the state in the store; if that fails the switch still stands, it just won't outlive us
+func (s *Server) saveNewSyncsAllowed(allowed bool) {
+
+	zLog.Info("Set accept_new_syncs", zap.Bool("value", allowed))
+
+	state, _ := json.Marshal(acceptNewSyncsState{
+		AcceptNewSyncs: allowed,
+		Configured:     !s.config.NoNewSyncs,
+	})
+	if err := s.store.PutSetting(acceptNewSyncsSetting, string(state)); err != nil {
+		zLog.Warn("Couldn't save accept_new_syncs; it will be reset on restart", zap.Error(err))
+	}
+}
@@ -0,0 +1,386 @@
+package server
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * the routes the browser extensions use, along with /info, the front page
+ * and the status page; the admin routes are off in admin.go
+ *
+ */
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/didip/tollbooth"
+	"github.com/didip/tollbooth/limiter"
+	"github.com/didip/tollbooth_gin"
+	"github.com/gin-gonic/gin"
+	"github.com/ishani/xSyn/store"
+	"go.uber.org/zap"
+)
+
+// CreateBookmarkData is received in POST /bookmarks; InviteCode is our own addition, for
+// invite-only servers, and can also be sent in the X-Invite-Code header
+type CreateBookmarkData struct {
+	ClientVersion string `json:"version"`
+	InviteCode    string `json:"inviteCode,omitempty"`
+}
+
+// RequestData is received by PUT /bookmarks/:id; newer clients also send the
+// lastUpdated value they last saw so we can detect if someone else has synced in the meantime
+type RequestData struct {
+	EncodedBookmarks string `json:"bookmarks"`
+	LastUpdated      string `json:"lastUpdated"`
+}
+
+// buildRouter sets up a Gin instance with all of the routes the config asks for
+func (s *Server) buildRouter() *gin.Engine {
+
+	// build a Gin instance; we bring our own logging rather than use Gin's
+	router := gin.New()
+	router.Use(gin.Recovery())
+
+	// log and count everything, including whatever the rate limiter turns away
+	if s.config.AccessLog {
+		router.Use(s.accessLog())
+	}
+	if s.metrics != nil {
+		router.Use(s.metrics.middleware(s.routeName))
+	}
+
+	// apply rate limiting middleware if specified
+	if s.config.RequestsPerSecond > 0 {
+
+		zLog.Info("Adding rate-limiting", zap.Float64("RPS", s.config.RequestsPerSecond))
+
+		// I've chosen a fairly arbitrary burst limit to allow XBS to poll a few things during a sync without
+		// exhausting the limits immediately as this limit is applied to all routes
+		limiter := tollbooth.NewLimiter(s.config.RequestsPerSecond, &limiter.ExpirableOptions{DefaultExpirationTTL: time.Hour})
+		limiter.SetBurst(20)
+		limiter.SetMessageContentType("application/json; charset=utf-8")
+		limiter.SetMessage(fmt.Sprintf(`{"code":%q,"message":%q}`, codeRequestThrottled, errorCodeMessage[codeRequestThrottled]))
+		router.Use(tollbooth_gin.LimitHandler(limiter))
+	}
+
+	// admin API, only available when there's a token to protect it
+	if len(s.config.AdminToken) > 0 || len(s.config.AdminTokenHash) > 0 {
+
+		zLog.Info("Enabling admin routes")
+
+		s.addAdminRoutes(router.Group("/admin", adminAuth(s.config.AdminToken, s.config.AdminTokenHash)))
+	}
+
+	// magic route to toggle new-sync option
+	if len(s.config.SyncToggleRoute) > 0 {
+
+		zLog.Info("Enabling sync toggling route")
+
+		router.GET(s.config.SyncToggleRoute, func(c *gin.Context) {
+			allowed := s.toggleNewSyncsAllowed()
+			c.String(200, fmt.Sprintf("Toggled accept_new_syncs to [%t]", allowed))
+		})
+	}
+
+	// route to create a new sync ID
+	router.POST("/bookmarks", func(c *gin.Context) {
+
+		// sorry, we're closed for business; otherwise this holds our place under any limits
+		reservation, closed := s.reserveNewSync()
+		if closed != nil {
+			s.metrics.newSyncRejected(closed.name)
+			handleError(c, closed.code, closed.message, fmt.Errorf("new syncs closed: %s", closed.name))
+			return
+		}
+
+		var bookmarkData CreateBookmarkData
+		if err := c.ShouldBindJSON(&bookmarkData); err != nil {
+			reservation.release()
+			handleError(c, codeRequiredDataNotFound, "", err)
+			return
+		}
+
+		inviteCode, ok := s.useInvite(c, &bookmarkData)
+		if !ok {
+			reservation.release()
+			return
+		}
+
+		zLog.Debug("New SyncID requested", zap.String("Client", bookmarkData.ClientVersion))
+
+		newID, imprintTime, err := s.store.CreateSync(bookmarkData.ClientVersion)
+
+		if err != nil {
+			reservation.release()
+			s.releaseInvite(inviteCode)
+		}
+		if handleError(c, codeUnspecifiedError, "", err) {
+			return
+		}
+		reservation.confirm(time.Now())
+
+		zLog.Debug("New key created", zap.String("key", store.RedactSyncID(newID)))
+		s.metrics.syncCreated()
+
+		c.JSON(200, gin.H{
+			"id":          newID,
+			"lastUpdated": imprintTime,
+			"version":     bookmarkData.ClientVersion,
+		})
+	})
+
+	// fetch the bookmarks data for the given SyncID
+	router.GET("/bookmarks/:id", func(c *gin.Context) {
+		markID := c.Param("id")
+
+		if !store.IsValidSyncID(markID) {
+			handleError(c, codeInvalidSyncID, "", errors.New("malformed sync ID"))
+			return
+		}
+
+		syncData, err := s.store.Get(markID)
+
+		if err == store.ErrSyncNotFound {
+			handleError(c, codeInvalidSyncID, "", err)
+			return
+		}
+		if handleError(c, codeUnspecifiedError, "", err) {
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"bookmarks":   syncData.Bookmarks,
+			"lastUpdated": syncData.LastUpdated,
+			"version":     syncData.Version,
+		})
+	})
+
+	sizeLimitedRoutes := router.Group("/", requestSizeLimiter(s.config.MaxSyncSizeBytes))
+	{
+		// replace bookmarks data for the given SyncID
+		sizeLimitedRoutes.PUT("/bookmarks/:id", func(c *gin.Context) {
+			markID := c.Param("id")
+
+			if !store.IsValidSyncID(markID) {
+				handleError(c, codeInvalidSyncID, "", errors.New("malformed sync ID"))
+				return
+			}
+
+			var bookmarkData RequestData
+			if err := c.ShouldBindJSON(&bookmarkData); err != nil {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					handleError(c, codeSyncDataLimitExceeded, "", err)
+					return
+				}
+				handleError(c, codeRequiredDataNotFound, "", err)
+				return
+			}
+			if len(bookmarkData.EncodedBookmarks) == 0 {
+				handleError(c, codeRequiredDataNotFound, "", errors.New("no bookmarks provided"))
+				return
+			}
+
+			imprintTime, err := s.store.Put(markID, bookmarkData.EncodedBookmarks, bookmarkData.LastUpdated)
+
+			switch err {
+			case store.ErrSyncNotFound:
+				handleError(c, codeInvalidSyncID, "", err)
+				return
+			case store.ErrSyncConflict:
+				handleError(c, codeSyncConflict, "", err)
+				return
+			}
+			if handleError(c, codeUnspecifiedError, "", err) {
+				return
+			}
+			s.metrics.syncWritten(len(bookmarkData.EncodedBookmarks))
+
+			c.JSON(200, gin.H{
+				"lastUpdated": imprintTime,
+			})
+		})
+	}
+
+	// return the timestamp of the last update for the given SyncID
+	router.GET("/bookmarks/:id/lastUpdated", func(c *gin.Context) {
+		markID := c.Param("id")
+
+		if !store.IsValidSyncID(markID) {
+			handleError(c, codeInvalidSyncID, "", errors.New("malformed sync ID"))
+			return
+		}
+
+		timestampString, err := s.store.LastUpdated(markID)
+
+		if err == store.ErrSyncNotFound {
+			handleError(c, codeInvalidSyncID, "", err)
+			return
+		}
+		if handleError(c, codeUnspecifiedError, "", err) {
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"lastUpdated": timestampString,
+		})
+	})
+
+	// return the client version used to create the SyncID
+	router.GET("/bookmarks/:id/version", func(c *gin.Context) {
+		markID := c.Param("id")
+
+		if !store.IsValidSyncID(markID) {
+			handleError(c, codeInvalidSyncID, "", errors.New("malformed sync ID"))
+			return
+		}
+
+		versionString, err := s.store.Version(markID)
+
+		if err == store.ErrSyncNotFound {
+			handleError(c, codeInvalidSyncID, "", err)
+			return
+		}
+		if handleError(c, codeUnspecifiedError, "", err) {
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"version": versionString,
+		})
+	})
+
+	router.GET("/info", func(c *gin.Context) {
+
+		serviceStatus := serviceStatusOnline
+		message := s.config.ServiceMessage
+
+		// when closed by one of the limits, say why, so people know whether to try again later
+		if closed := s.newSyncsClosed(); closed != nil {
+			serviceStatus = serviceStatusNoNewSyncs
+			if closed != closedByToggle {
+				message = strings.TrimSpace(message + "\n\n" + closed.message)
+			}
+		} else if s.config.InviteOnly {
+			// the extensions can't send an invite code, so as far as they're concerned we're closed
+			serviceStatus = serviceStatusNoNewSyncs
+			message = strings.TrimSpace(message + "\n\n" + "New syncs on this service are by invitation only")
+		}
+
+		info := gin.H{
+			"status":      serviceStatus,
+			"message":     message,
+			"version":     apiVersion(),
+			"buildstamp":  s.config.BuildStamp,
+			"maxSyncSize": s.config.MaxSyncSizeBytes,
+		}
+
+		// location is optional, clients only show it if present
+		if len(s.config.Location) > 0 {
+			info["location"] = strings.ToUpper(s.config.Location)
+		}
+
+		c.JSON(200, info)
+	})
+
+	// show a basic front page
+	// .. passing in nil for the data means we don't show any statistics
+	router.GET("/", func(c *gin.Context) {
+		renderFrontPage(c, nil)
+	})
+
+	// .. unlike for this route, which shows the front page but
+	// also a bunch of internal stats from the store; the URL for this page
+	// can be set in config to something obfuscated if desired
+	if len(s.config.StatusRoute) > 0 {
+		router.GET(s.config.StatusRoute, s.statusPage)
+	}
+
+	// scrapeable metrics, for Prometheus and the like
+	if s.metrics != nil {
+
+		zLog.Info("Enabling metrics route", zap.String("route", s.config.MetricsRoute))
+
+		if len(s.config.MetricsToken) > 0 {
+			router.GET(s.config.MetricsRoute, adminAuth(s.config.MetricsToken, ""), s.metrics.handler())
+		} else {
+			router.GET(s.config.MetricsRoute, s.metrics.handler())
+		}
+	}
+
+	return router
+}
+
+func (s *Server) statusPage(c *gin.Context) {
+
+	// monitoring tools can ask for the same thing as JSON
+	if wantsJSON(c) {
+		report, _ := s.buildStatusReport()
+		c.JSON(200, report)
+		return
+	}
+
+	// the backend-specific stats are shown alongside our own; if these can't be
+	// fetched for some reason, we still show the page with what we have
+	stats, err := s.store.Stats()
+	if err != nil {
+		zLog.Warn("Store stats", zap.Error(err))
+		stats = &store.Stats{}
+	}
+
+	// top level holder of key->data
+	datamap := make(map[string]interface{})
+
+	// pop in the misc stat fragments
+	dbstat := make(map[string]interface{})
+	dbstat["key count"] = stats.KeyCount
+	dbstat["db size (bytes)"] = stats.SizeBytes
+	dbstat["build stamp"] = s.config.BuildStamp
+	dbstat["boot time"] = s.bootTime.Format(time.RFC850)
+	datamap["State"] = dbstat
+
+	if s.syncPruner != nil {
+		datamap["Pruning"] = s.syncPruner.stats()
+	}
+	if s.backups != nil {
+		datamap["Backups"] = s.backups.stats()
+	}
+
+	// .. and then whatever else the store wants to show
+	for key, value := range stats.Details {
+		datamap[key] = value
+	}
+
+	renderFrontPage(c, datamap)
+}
+
+// fill in the front page template; this is rendered up front rather than streamed, as
+// streaming needs a ResponseWriter that supports CloseNotify, and when we're mounted
+// inside someone else's service there's no saying what we've been handed
+func renderFrontPage(c *gin.Context, data map[string]interface{}) {
+
+	t, err := template.New("frontpage").Parse(frontpageHTML)
+	if handleError(c, codeUnspecifiedError, "", err) {
+		return
+	}
+
+	var page bytes.Buffer
+	if handleError(c, codeUnspecifiedError, "", t.Execute(&page, data)) {
+		return
+	}
+
+	c.Data(200, "text/html; charset=utf-8", page.Bytes())
+}
+
+// wrap the request body so that reading past the given limit fails with an *http.MaxBytesError,
+// which the handlers turn into a SyncDataLimitExceededException
+func requestSizeLimiter(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
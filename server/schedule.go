@@ -0,0 +1,198 @@
+package server
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * a weekly schedule of windows when new syncs are accepted, written as a
+ * list of windows separated by semicolons, each a set of days and a span
+ * of time, eg.
+ *
+ *   Mon-Fri 09:00-17:00; Sat,Sun 10:00-12:00
+ *
+ * days are Mon..Sun, as single days, lists or ranges (which may wrap round,
+ * like Fri-Mon), or * for every day; leaving the days out means every day,
+ * and leaving the time out means all day. a span that ends before it starts,
+ * like 22:00-02:00, runs on past midnight into the next day
+ *
+ */
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var scheduleDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// scheduleWindow is one entry from the schedule; start and end are minutes into the day
+type scheduleWindow struct {
+	days       [7]bool
+	start, end int
+}
+
+type openSchedule struct {
+	windows  []scheduleWindow
+	location *time.Location
+	spec     string
+}
+
+// parseSchedule reads a schedule as described above, with the times in the given location
+func parseSchedule(spec string, location *time.Location) (*openSchedule, error) {
+
+	schedule := &openSchedule{location: location, spec: spec}
+
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		window := scheduleWindow{start: 0, end: 24 * 60}
+		daysSpec, timeSpec := "*", ""
+
+		fields := strings.Fields(entry)
+		switch len(fields) {
+		case 1:
+			if strings.Contains(fields[0], ":") {
+				timeSpec = fields[0]
+			} else {
+				daysSpec = fields[0]
+			}
+		case 2:
+			daysSpec, timeSpec = fields[0], fields[1]
+		default:
+			return nil, fmt.Errorf("[%s]; expected days and a time span, like Mon-Fri 09:00-17:00", entry)
+		}
+
+		if err := window.parseDays(daysSpec); err != nil {
+			return nil, fmt.Errorf("[%s]: %s", entry, err)
+		}
+		if len(timeSpec) > 0 {
+			if err := window.parseSpan(timeSpec); err != nil {
+				return nil, fmt.Errorf("[%s]: %s", entry, err)
+			}
+		}
+
+		schedule.windows = append(schedule.windows, window)
+	}
+
+	if len(schedule.windows) == 0 {
+		return nil, fmt.Errorf("no windows in [%s]", spec)
+	}
+	return schedule, nil
+}
+
+func (w *scheduleWindow) parseDays(spec string) error {
+
+	if spec == "*" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+
+	for _, part := range strings.Split(spec, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+
+		first, ok := scheduleDays[strings.ToLower(from)]
+		if !ok {
+			return fmt.Errorf("unknown day [%s]", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = scheduleDays[strings.ToLower(to)]; !ok {
+				return fmt.Errorf("unknown day [%s]", to)
+			}
+		}
+
+		for day := first; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (w *scheduleWindow) parseSpan(spec string) error {
+
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return fmt.Errorf("time span [%s] should be HH:MM-HH:MM", spec)
+	}
+
+	var err error
+	if w.start, err = parseClock(from); err != nil {
+		return err
+	}
+	if w.start == 24*60 {
+		return fmt.Errorf("time span [%s] can't start at 24:00, that's 00:00 the day after", spec)
+	}
+	if w.end, err = parseClock(to); err != nil {
+		return err
+	}
+	if w.start == w.end {
+		return fmt.Errorf("time span [%s] is empty", spec)
+	}
+	return nil
+}
+
+// parseClock turns HH:MM into minutes into the day; 24:00 is allowed, for the end of one,
+// and parseSpan turns it away as a start
+func parseClock(clock string) (int, error) {
+
+	hours, minutes, ok := strings.Cut(clock, ":")
+	h, errH := strconv.Atoi(hours)
+	m, errM := strconv.Atoi(minutes)
+	if !ok || errH != nil || errM != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("[%s] isn't a time of day, like 09:30", clock)
+	}
+	return h*60 + m, nil
+}
+
+// openAt checks whether any of the windows is open at the given time
+func (s *openSchedule) openAt(t time.Time) bool {
+
+	local := t.In(s.location)
+	day := local.Weekday()
+	yesterday := (day + 6) % 7
+	minute := local.Hour()*60 + local.Minute()
+
+	for i := range s.windows {
+		w := &s.windows[i]
+		if w.start < w.end {
+			if w.days[day] && minute >= w.start && minute < w.end {
+				return true
+			}
+		} else {
+			// runs past midnight; open late on its own days, and early on the day after
+			if (w.days[day] && minute >= w.start) || (w.days[yesterday] && minute < w.end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nextOpening finds when the schedule next opens after the given time, to the minute; the
+// zero time if it never does, which can't happen with a schedule that parsed
+func (s *openSchedule) nextOpening(t time.Time) time.Time {
+
+	next := t.In(s.location).Truncate(time.Minute)
+	for i := 0; i < 7*24*60; i++ {
+		next = next.Add(time.Minute)
+		if s.openAt(next) {
+			return next
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,190 @@
+package server
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * the registration schedule and limits, checked against fixed times
+ *
+ */
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ishani/xSyn/store"
+)
+
+// 2024-01-01 was a Monday
+func testTime(day int, clock string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", "2024-01-0"+string(rune('0'+day))+" "+clock)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestSchedule(t *testing.T) {
+	schedule, err := parseSchedule("Mon-Fri 09:00-17:00; Sat 22:00-02:00; sun", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		day   int
+		clock string
+		open  bool
+	}{
+		{1, "08:59", false},
+		{1, "09:00", true},
+		{5, "16:59", true},
+		{5, "17:00", false},
+		{6, "21:59", false},
+		{6, "23:30", true},
+		{7, "01:59", true}, // Sat's window running on into Sun, which is open all day anyway
+		{7, "12:00", true},
+	}
+	for _, tt := range tests {
+		if got := schedule.openAt(testTime(tt.day, tt.clock)); got != tt.open {
+			t.Errorf("day %d %s: open %t, want %t", tt.day, tt.clock, got, tt.open)
+		}
+	}
+
+	if next := schedule.nextOpening(testTime(5, "17:00")); !next.Equal(testTime(6, "22:00")) {
+		t.Errorf("next opening after Fri 17:00 is %s", next)
+	}
+
+	for _, bad := range []string{"", "Mon-Funday 09:00-17:00", "Mon 9-17", "Mon 09:00-09:00", "Mon 09:00-25:00", "Mon 24:00-00:00", "Mon 24:00-02:00", "Mon Tue 09:00-10:00"} {
+		if _, err := parseSchedule(bad, time.UTC); err == nil {
+			t.Errorf("schedule [%s] parsed", bad)
+		}
+	}
+}
+
+func TestNewSyncLimits(t *testing.T) {
+	limits, err := newSyncLimitsFromConfig(Config{NewSyncsPerHour: 2}, store.NewMemory(store.HistoryPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := testTime(1, "10:00")
+	var reservations []*syncReservation
+	for i := 0; i < 2; i++ {
+		reservation, closed := limits.reserve(now)
+		if closed != nil {
+			t.Fatalf("closed after %d: %s", i, closed.message)
+		}
+		reservations = append(reservations, reservation)
+	}
+	if _, closed := limits.reserve(now); closed == nil || closed.name != "hourly" || closed.code != codeNewSyncsLimitExceeded {
+		t.Fatalf("expected the hourly limit, got %v", closed)
+	}
+
+	// a failed creation gives its place back
+	reservations[0].release()
+	if _, closed := limits.reserve(now); closed != nil {
+		t.Fatalf("closed after release: %s", closed.message)
+	}
+
+	// and the next hour has a fresh allowance
+	next, closed := limits.reserve(testTime(1, "11:00"))
+	if closed != nil {
+		t.Fatalf("closed in the next hour: %s", closed.message)
+	}
+	if _, closed = limits.reserve(testTime(1, "11:00")); closed != nil {
+		t.Fatalf("closed in the next hour: %s", closed.message)
+	}
+
+	// which a reservation from the hour before can't add to when it's handed back
+	reservations[1].release()
+	if closed := limits.check(testTime(1, "11:30")); closed == nil || closed.name != "hourly" {
+		t.Fatalf("expected the hourly limit, got %v", closed)
+	}
+	next.release()
+	if closed := limits.check(testTime(1, "11:30")); closed != nil {
+		t.Fatalf("closed after release: %s", closed.message)
+	}
+}
+
+func TestNewSyncDailyRollover(t *testing.T) {
+	limits, err := newSyncLimitsFromConfig(Config{NewSyncsPerDay: 1}, store.NewMemory(store.HistoryPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yesterday, closed := limits.reserve(testTime(1, "23:59"))
+	if closed != nil {
+		t.Fatalf("closed: %s", closed.message)
+	}
+	if _, closed = limits.reserve(testTime(2, "00:01")); closed != nil {
+		t.Fatalf("closed on a new day: %s", closed.message)
+	}
+
+	yesterday.release()
+	if closed = limits.check(testTime(2, "00:02")); closed == nil || closed.name != "daily" {
+		t.Fatalf("expected the daily limit, got %v", closed)
+	}
+}
+
+func TestNewSyncCapacity(t *testing.T) {
+	syncStore := store.NewMemory(store.HistoryPolicy{})
+	limits, err := newSyncLimitsFromConfig(Config{MaxSyncs: 3}, syncStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one already in the store, found when the limits first look, one created after and a
+	// third still being created
+	syncStore.CreateSync("1.5.2")
+	now := testTime(1, "10:00")
+	created, closed := limits.reserve(now)
+	if closed != nil {
+		t.Fatalf("closed with room to spare: %s", closed.message)
+	}
+	syncStore.CreateSync("1.5.2")
+	created.confirm(now)
+
+	pending, closed := limits.reserve(now)
+	if closed != nil {
+		t.Fatalf("closed with room to spare: %s", closed.message)
+	}
+	if closed = limits.check(now); closed == nil || closed.name != "capacity" {
+		t.Fatalf("expected the capacity limit, got %v", closed)
+	}
+
+	// a recount of the store only finds two, but the one still being created holds its place
+	if closed = limits.check(now.Add(keyCountRefresh)); closed == nil || closed.name != "capacity" {
+		t.Fatalf("expected the capacity limit after recounting, got %v", closed)
+	}
+
+	// until it fails, when there's room again
+	pending.release()
+	if closed = limits.check(now.Add(keyCountRefresh)); closed != nil {
+		t.Fatalf("closed after release: %s", closed.message)
+	}
+}
+
+func TestNewSyncRecountBeforeConfirm(t *testing.T) {
+	syncStore := store.NewMemory(store.HistoryPolicy{})
+	limits, err := newSyncLimitsFromConfig(Config{MaxSyncs: 2}, syncStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sync makes it into the store, but a recount finds it before it's confirmed
+	now := testTime(1, "10:00")
+	reservation, closed := limits.reserve(now)
+	if closed != nil {
+		t.Fatalf("closed with room to spare: %s", closed.message)
+	}
+	syncStore.CreateSync("1.5.2")
+	recount := now.Add(keyCountRefresh)
+	limits.check(recount)
+	reservation.confirm(now)
+
+	// so confirming it mustn't count it a second time
+	if closed = limits.check(recount); closed != nil {
+		t.Fatalf("closed with one sync of two: %s", closed.message)
+	}
+	if limits.keyCount != 1 || limits.reserved != 0 {
+		t.Fatalf("key count %d with %d reserved, want 1 and 0", limits.keyCount, limits.reserved)
+	}
+}
@@ -0,0 +1,401 @@
+package server
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * the sync server itself, as a package so that it can be mounted inside
+ * other Go services as well as run by the xsyn binary; build a Server from a
+ * Config and an opened store.Store, then either call Run to have it listen by
+ * itself, or hang Handler() off an existing mux, eg.
+ *
+ *   syncStore, _ := store.OpenBolt("marks.db", 5*time.Second, store.HistoryPolicy{}, false)
+ *   srv, _ := server.New(server.Config{}, syncStore)
+ *   mux.Handle("/xbs/", http.StripPrefix("/xbs", srv.Handler()))
+ *
+ * mounted like that, background jobs like pruning and scheduled backups are
+ * not running; those are started by Run, and stopped again by Shutdown
+ *
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ishani/xSyn/store"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// zLog is where the server reports what it's doing; silent until SetLogger is called
+var zLog = zap.NewNop()
+
+// SetLogger sets the logger used by every server in the package
+func SetLogger(logger *zap.Logger) {
+	zLog = logger
+}
+
+// the sync size limit used when the config doesn't set one
+const defaultMaxSyncSizeBytes = 500 * 1024
+
+// how long Run gives requests in flight to finish when its context is cancelled, unless
+// the config says otherwise
+const defaultShutdownTimeout = 10 * time.Second
+
+// Config is everything the server needs to know, other than where to keep the bookmarks; the
+// zero value serves plain HTTP on port 80 with all of the optional extras turned off
+type Config struct {
+	// Port is what Run listens on, unless LetsEncrypt is set, which needs both 80 and 443
+	Port int
+
+	// ServiceMessage is shown to clients by /info, along with Location if it's set; an
+	// ISO 3166-1 alpha-2 country code for where the server is hosted
+	ServiceMessage string
+	Location       string
+
+	// MaxSyncSizeBytes limits the size of each sync ID's bookmarks data; 0 for the default of 500kb
+	MaxSyncSizeBytes int64
+
+	// StatusRoute shows the front page along with the store's stats; "" to disable
+	StatusRoute string
+
+	// NoNewSyncs starts the server refusing to create new sync IDs
+	NoNewSyncs bool
+
+	// MaxSyncs closes registrations while the store holds that many sync IDs, and NewSyncsPerHour
+	// and NewSyncsPerDay once that many have been created in the current hour or day (UTC);
+	// OpenSchedule only accepts new syncs within its windows (see schedule.go), in ScheduleLocation's
+	// time, or UTC if that's nil. 0 or "" for any of these to leave it out
+	MaxSyncs         int
+	NewSyncsPerHour  int
+	NewSyncsPerDay   int
+	OpenSchedule     string
+	ScheduleLocation *time.Location
+
+	// InviteOnly only creates new sync IDs for clients with an invite code; see invites.go
+	InviteOnly bool
+
+	// SyncToggleRoute flips whether new sync IDs can be created whenever it's visited; "" to disable.
+	// this, or the admin API, switching it is remembered by the store across restarts, until
+	// NoNewSyncs itself is changed
+	SyncToggleRoute string
+
+	// RequestsPerSecond rate-limits each client across all routes; 0 to disable
+	RequestsPerSecond float64
+
+	// TLSCert is a file prefix for a certificate and key (TLSCert.pem and TLSCert.key) to serve
+	// HTTPS with; failing that, LetsEncrypt is a domain to fetch certificates for, which are
+	// cached in the LetsEncryptCache directory, or in memory if that's "". these only affect Run
+	TLSCert          string
+	LetsEncrypt      string
+	LetsEncryptCache string
+
+	// AdminToken, or a bcrypt hash of it in AdminTokenHash, enables the /admin routes
+	AdminToken     string
+	AdminTokenHash string
+
+	// PruneInactive enables deleting sync IDs that haven't been read or written in that
+	// long, checking every PruneInterval; 0 for either to disable
+	PruneInactive time.Duration
+	PruneInterval time.Duration
+
+	// MetricsRoute serves Prometheus metrics, protected by MetricsToken as a bearer token
+	// unless that's ""; "" to disable metrics altogether
+	MetricsRoute string
+	MetricsToken string
+
+	// BackupDir enables backups into that directory, created if missing; they're taken every
+	// BackupInterval, or only via the admin API if that's 0, and only the newest BackupKeep
+	// are kept, or all of them if that's 0
+	BackupDir      string
+	BackupInterval time.Duration
+	BackupKeep     int
+	BackupCompress bool
+
+	// AccessLog logs every request to the logger given to SetLogger, with sync IDs shortened
+	AccessLog bool
+
+	// ShutdownTimeout is how long Run waits for requests in flight to finish once its context is
+	// cancelled, before closing their connections regardless; 0 for the default of 10 seconds
+	ShutdownTimeout time.Duration
+
+	// BuildStamp identifies the build on the status page, /info and in backups
+	BuildStamp string
+}
+
+// Server serves the xBrowserSync API from a store
+type Server struct {
+	config   Config
+	store    store.Store
+	router   *gin.Engine
+	bootTime time.Time
+
+	// background jobs, either of which may be nil if not configured
+	syncPruner *pruner
+	backups    *backupScheduler
+
+	// nil unless there's a metrics route
+	metrics *serverMetrics
+
+	// whether we accept new sync IDs - ie. new users for the service; see registration.go
+	newSyncsAllowed atomic.Bool
+	newSyncsLock    sync.Mutex
+
+	// nil unless any of the limits on new syncs are set
+	limits *newSyncLimits
+
+	// what Run has started, so that Shutdown can stop it again
+	lock        sync.Mutex
+	listeners   []*listener
+	stopJobs    context.CancelFunc
+	jobsRunning sync.WaitGroup
+}
+
+// New builds a server around the given store, which it uses but doesn't close
+func New(config Config, syncStore store.Store) (*Server, error) {
+
+	if config.MaxSyncSizeBytes <= 0 {
+		config.MaxSyncSizeBytes = defaultMaxSyncSizeBytes
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = defaultShutdownTimeout
+	}
+
+	s := &Server{
+		config:   config,
+		store:    syncStore,
+		bootTime: time.Now().UTC(),
+	}
+
+	if err := s.loadNewSyncsAllowed(); err != nil {
+		return nil, fmt.Errorf("accept_new_syncs setting: %s", err)
+	}
+
+	limits, err := newSyncLimitsFromConfig(config, syncStore)
+	if err != nil {
+		return nil, err
+	}
+	s.limits = limits
+
+	// if a cache path was given for LetsEncrypt, trial-run the creation of it
+	// so we know early on that the storage has been configured correctly
+	if len(config.LetsEncryptCache) > 0 {
+		if err := os.MkdirAll(config.LetsEncryptCache, 0700); err != nil {
+			return nil, fmt.Errorf("LE cache path: %s", err)
+		}
+	}
+
+	if config.PruneInactive > 0 && config.PruneInterval > 0 {
+		s.syncPruner = newPruner(syncStore, config.PruneInactive, config.PruneInterval)
+	}
+
+	// backups into a local directory, on a schedule and/or when asked via the admin API
+	if len(config.BackupDir) > 0 {
+		if err := os.MkdirAll(config.BackupDir, 0700); err != nil {
+			return nil, fmt.Errorf("backup path: %s", err)
+		}
+		s.backups = newBackupScheduler(
+			syncStore,
+			config.BackupDir,
+			config.BackupInterval,
+			config.BackupKeep,
+			config.BackupCompress,
+			config.BuildStamp,
+		)
+	}
+
+	if len(config.MetricsRoute) > 0 {
+		s.metrics = newServerMetrics(s)
+	}
+
+	s.router = s.buildRouter()
+	return s, nil
+}
+
+// Handler returns the server's routes, for mounting under another mux
+func (s *Server) Handler() http.Handler {
+	return s.router
+}
+
+// a single HTTP server started by Run, and how to start it
+type listener struct {
+	server   *http.Server
+	tls      bool
+	certFile string
+	keyFile  string
+}
+
+func (l *listener) serve() error {
+	if l.tls {
+		return l.server.ListenAndServeTLS(l.certFile, l.keyFile)
+	}
+	return l.server.ListenAndServe()
+}
+
+// pick how to listen, going by the TLS options in the config
+func (s *Server) buildListeners() []*listener {
+
+	launchString := fmt.Sprintf(":%d", s.config.Port)
+
+	if len(s.config.TLSCert) > 0 {
+
+		zLog.Info("Starting server", zap.String("mode", "https"))
+
+		return []*listener{{
+			server:   &http.Server{Addr: launchString, Handler: s.router},
+			tls:      true,
+			certFile: fmt.Sprintf("%s.pem", s.config.TLSCert),
+			keyFile:  fmt.Sprintf("%s.key", s.config.TLSCert),
+		}}
+
+	} else if len(s.config.LetsEncrypt) > 0 {
+
+		zLog.Info("Starting server", zap.String("mode", "https-lets-encrypt"))
+
+		autocertmgr := &autocert.Manager{
+			Prompt:     synAcceptTOS,
+			HostPolicy: autocert.HostWhitelist(s.config.LetsEncrypt),
+		}
+		if len(s.config.LetsEncryptCache) > 0 {
+			autocertmgr.Cache = autocert.DirCache(s.config.LetsEncryptCache)
+		}
+
+		// certificates are served on :443, while :80 answers the ACME challenges
+		// and redirects everything else over to https
+		return []*listener{
+			{
+				server: &http.Server{Addr: ":https", Handler: s.router, TLSConfig: autocertmgr.TLSConfig()},
+				tls:    true,
+			},
+			{
+				server: &http.Server{Addr: ":http", Handler: autocertmgr.HTTPHandler(nil)},
+			},
+		}
+	}
+
+	zLog.Info("Starting server", zap.String("mode", "http"))
+
+	return []*listener{{
+		server: &http.Server{Addr: launchString, Handler: s.router},
+	}}
+}
+
+func synAcceptTOS(tosURL string) bool {
+	zLog.Info("Autocert TOS", zap.String("URL", tosURL))
+	return true
+}
+
+// Run starts the background jobs and serves until the context is cancelled or Shutdown is called,
+// either of which count as a clean exit; anything else that stops the server is returned. when
+// the context is cancelled, Run only returns once everything has wound down, so the store can be
+// closed straight after; a Shutdown from elsewhere has Run return right away, as with http.Server
+func (s *Server) Run(ctx context.Context) error {
+
+	s.lock.Lock()
+	if s.listeners != nil {
+		s.lock.Unlock()
+		return errors.New("server is already running")
+	}
+	jobs, stopJobs := context.WithCancel(context.Background())
+	s.stopJobs = stopJobs
+	s.listeners = s.buildListeners()
+	listeners := s.listeners
+	s.lock.Unlock()
+
+	// kick off the background pruning of abandoned sync IDs, if enabled
+	if s.syncPruner != nil {
+		zLog.Info("Enabling pruning", zap.Duration("inactive", s.config.PruneInactive))
+		s.startJob(jobs, s.syncPruner.run)
+	}
+	if s.backups != nil && s.config.BackupInterval > 0 {
+		zLog.Info("Enabling scheduled backups", zap.Duration("interval", s.config.BackupInterval))
+		s.startJob(jobs, s.backups.run)
+	}
+
+	serveErrors := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l *listener) {
+			serveErrors <- l.serve()
+		}(l)
+	}
+
+	select {
+	case <-ctx.Done():
+		zLog.Info("Shutting down", zap.Duration("timeout", s.config.ShutdownTimeout))
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+		defer cancel()
+
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			// out of patience; cut off whoever is left. their handlers may still be running,
+			// but the store will wait for any transaction they're in the middle of
+			zLog.Warn("Requests still in flight after shutdown timeout, closing", zap.Error(err))
+			for _, l := range listeners {
+				l.server.Close()
+			}
+		}
+		return nil
+
+	case err := <-serveErrors:
+		if err == http.ErrServerClosed {
+			return nil
+		}
+
+		// one failed to start, most likely; take down anything else we started with it
+		stopJobs()
+		for _, l := range listeners {
+			l.server.Close()
+		}
+		return err
+	}
+}
+
+// startJob runs a background job until the context is cancelled, tracking it so Shutdown can wait for it
+func (s *Server) startJob(ctx context.Context, job func(context.Context)) {
+	s.jobsRunning.Add(1)
+	go func() {
+		defer s.jobsRunning.Done()
+		job(ctx)
+	}()
+}
+
+// Shutdown stops the background jobs and stops accepting new connections, then waits for requests
+// in flight, and any prune or backup that's under way, to finish until the context expires; it's a
+// no-op if Run hasn't been called
+func (s *Server) Shutdown(ctx context.Context) error {
+
+	s.lock.Lock()
+	listeners := s.listeners
+	stopJobs := s.stopJobs
+	s.lock.Unlock()
+
+	if stopJobs != nil {
+		stopJobs()
+	}
+
+	var firstErr error
+	for _, l := range listeners {
+		if err := l.server.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	jobsDone := make(chan struct{})
+	go func() {
+		s.jobsRunning.Wait()
+		close(jobsDone)
+	}()
+	select {
+	case <-jobsDone:
+	case <-ctx.Done():
+		if firstErr == nil {
+			firstErr = ctx.Err()
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,674 @@
+package server
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * conformance tests for the routes the browser extensions use, run against
+ * the in-memory store; these check the exact status codes and JSON shapes
+ * the official server produces, since that's what the clients switch on
+ *
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ishani/xSyn/store"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+const testToggleRoute = "/toggle-new-syncs"
+const testStatusRoute = "/stat"
+
+// newTestServer builds a server on an empty in-memory store; config tweaks the defaults below
+func newTestServer(t *testing.T, config func(c *Config)) http.Handler {
+	t.Helper()
+
+	c := Config{
+		ServiceMessage:   "testing",
+		MaxSyncSizeBytes: 1024,
+		StatusRoute:      testStatusRoute,
+		SyncToggleRoute:  testToggleRoute,
+		BuildStamp:       "test-build",
+	}
+	if config != nil {
+		config(&c)
+	}
+
+	srv, err := New(c, store.NewMemory(store.HistoryPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv.Handler()
+}
+
+// send a request and return the status along with the raw response body
+func send(t *testing.T, h http.Handler, method, path, body string) (int, string) {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Code, w.Body.String()
+}
+
+// send a request, expecting the given status and a JSON object back
+func sendJSON(t *testing.T, h http.Handler, method, path, body string, wantStatus int) map[string]interface{} {
+	t.Helper()
+
+	status, responseBody := send(t, h, method, path, body)
+	if status != wantStatus {
+		t.Fatalf("%s %s: status %d, want %d; body %s", method, path, status, wantStatus, responseBody)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal([]byte(responseBody), &result); err != nil {
+		t.Fatalf("%s %s: response isn't a JSON object: %s; body %s", method, path, err, responseBody)
+	}
+	return result
+}
+
+// check a response has exactly the given fields, no more and no less
+func expectFields(t *testing.T, result map[string]interface{}, fields ...string) {
+	t.Helper()
+
+	var got []string
+	for field := range result {
+		got = append(got, field)
+	}
+	sort.Strings(got)
+	sort.Strings(fields)
+
+	if strings.Join(got, ",") != strings.Join(fields, ",") {
+		t.Fatalf("response has fields %v, want %v", got, fields)
+	}
+}
+
+// check for the {code, message} body that goes with each error
+func expectError(t *testing.T, h http.Handler, method, path, body string, wantStatus int, wantCode string) {
+	t.Helper()
+
+	result := sendJSON(t, h, method, path, body, wantStatus)
+	expectFields(t, result, "code", "message")
+	if result["code"] != wantCode {
+		t.Fatalf("%s %s: code %v, want %s", method, path, result["code"], wantCode)
+	}
+	if result["message"] != errorCodeMessage[wantCode] {
+		t.Fatalf("%s %s: message %q, want %q", method, path, result["message"], errorCodeMessage[wantCode])
+	}
+}
+
+// check a timestamp is in the "2016-07-06T12:43:16.866Z" form the clients expect
+func expectTimestamp(t *testing.T, value interface{}) string {
+	t.Helper()
+
+	timestamp, ok := value.(string)
+	if !ok {
+		t.Fatalf("timestamp %v isn't a string", value)
+	}
+	parsed, err := time.Parse(store.TimestampFormat, timestamp)
+	if err != nil || parsed.Format(store.TimestampFormat) != timestamp || !strings.HasSuffix(timestamp, "Z") {
+		t.Fatalf("timestamp %q isn't in the expected format", timestamp)
+	}
+	return timestamp
+}
+
+// create a new sync ID, returning it along with its lastUpdated
+func createSync(t *testing.T, h http.Handler) (string, string) {
+	t.Helper()
+
+	result := sendJSON(t, h, "POST", "/bookmarks", `{"version":"1.5.2"}`, 200)
+	return result["id"].(string), result["lastUpdated"].(string)
+}
+
+// an ID in the right format that the store has never seen
+const unknownSyncID = "0123456789abcdef0123456789abcdef"
+
+func TestCreateSync(t *testing.T) {
+	h := newTestServer(t, nil)
+
+	result := sendJSON(t, h, "POST", "/bookmarks", `{"version":"1.5.2"}`, 200)
+	expectFields(t, result, "id", "lastUpdated", "version")
+
+	id, _ := result["id"].(string)
+	if !store.IsValidSyncID(id) {
+		t.Fatalf("new sync ID %q isn't 32 hex characters", id)
+	}
+	expectTimestamp(t, result["lastUpdated"])
+	if result["version"] != "1.5.2" {
+		t.Fatalf("version %v, want 1.5.2", result["version"])
+	}
+
+	// each one is new
+	other, _ := createSync(t, h)
+	if other == id {
+		t.Fatalf("two creates gave the same sync ID %s", id)
+	}
+}
+
+func TestCreateSyncMalformed(t *testing.T) {
+	h := newTestServer(t, nil)
+
+	expectError(t, h, "POST", "/bookmarks", `{"version":`, 400, codeRequiredDataNotFound)
+	expectError(t, h, "POST", "/bookmarks", ``, 400, codeRequiredDataNotFound)
+}
+
+func TestGetBookmarks(t *testing.T) {
+	h := newTestServer(t, nil)
+	id, created := createSync(t, h)
+
+	// nothing synced yet, so the bookmarks are empty
+	result := sendJSON(t, h, "GET", "/bookmarks/"+id, "", 200)
+	expectFields(t, result, "bookmarks", "lastUpdated", "version")
+	if result["bookmarks"] != "" || result["lastUpdated"] != created || result["version"] != "1.5.2" {
+		t.Fatalf("unexpected fresh sync %v", result)
+	}
+
+	updated := sendJSON(t, h, "PUT", "/bookmarks/"+id, `{"bookmarks":"encrypted"}`, 200)
+
+	result = sendJSON(t, h, "GET", "/bookmarks/"+id, "", 200)
+	if result["bookmarks"] != "encrypted" || result["lastUpdated"] != updated["lastUpdated"] {
+		t.Fatalf("unexpected synced bookmarks %v", result)
+	}
+}
+
+func TestGetBookmarksUnknownID(t *testing.T) {
+	h := newTestServer(t, nil)
+
+	expectError(t, h, "GET", "/bookmarks/"+unknownSyncID, "", 401, codeInvalidSyncID)
+	expectError(t, h, "GET", "/bookmarks/not-a-sync-id", "", 401, codeInvalidSyncID)
+}
+
+func TestPutBookmarks(t *testing.T) {
+	h := newTestServer(t, nil)
+	id, created := createSync(t, h)
+
+	result := sendJSON(t, h, "PUT", "/bookmarks/"+id, `{"bookmarks":"first","lastUpdated":"`+created+`"}`, 200)
+	expectFields(t, result, "lastUpdated")
+	first := expectTimestamp(t, result["lastUpdated"])
+	if first == created {
+		t.Fatalf("lastUpdated didn't move on from %s", created)
+	}
+
+	// older clients don't send lastUpdated at all, and always win
+	result = sendJSON(t, h, "PUT", "/bookmarks/"+id, `{"bookmarks":"second"}`, 200)
+	second := expectTimestamp(t, result["lastUpdated"])
+	if second == first {
+		t.Fatalf("lastUpdated didn't move on from %s", first)
+	}
+}
+
+func TestPutBookmarksConflict(t *testing.T) {
+	h := newTestServer(t, nil)
+	id, created := createSync(t, h)
+
+	sendJSON(t, h, "PUT", "/bookmarks/"+id, `{"bookmarks":"first","lastUpdated":"`+created+`"}`, 200)
+
+	// a second client still holding the original lastUpdated has missed the first sync
+	expectError(t, h, "PUT", "/bookmarks/"+id, `{"bookmarks":"second","lastUpdated":"`+created+`"}`, 409, codeSyncConflict)
+
+	result := sendJSON(t, h, "GET", "/bookmarks/"+id, "", 200)
+	if result["bookmarks"] != "first" {
+		t.Fatalf("conflicting sync was stored; bookmarks %v", result["bookmarks"])
+	}
+}
+
+func TestPutBookmarksErrors(t *testing.T) {
+	h := newTestServer(t, nil)
+	id, _ := createSync(t, h)
+
+	expectError(t, h, "PUT", "/bookmarks/"+unknownSyncID, `{"bookmarks":"data"}`, 401, codeInvalidSyncID)
+	expectError(t, h, "PUT", "/bookmarks/not-a-sync-id", `{"bookmarks":"data"}`, 401, codeInvalidSyncID)
+	expectError(t, h, "PUT", "/bookmarks/"+id, `{"bookmarks":`, 400, codeRequiredDataNotFound)
+	expectError(t, h, "PUT", "/bookmarks/"+id, `{"bookmarks":""}`, 400, codeRequiredDataNotFound)
+	expectError(t, h, "PUT", "/bookmarks/"+id, `{}`, 400, codeRequiredDataNotFound)
+}
+
+func TestPutBookmarksTooLarge(t *testing.T) {
+	h := newTestServer(t, nil)
+	id, _ := createSync(t, h)
+
+	// the test server allows 1kb per sync
+	oversized := `{"bookmarks":"` + strings.Repeat("x", 2048) + `"}`
+	expectError(t, h, "PUT", "/bookmarks/"+id, oversized, 413, codeSyncDataLimitExceeded)
+
+	// and leaves what was there alone
+	result := sendJSON(t, h, "GET", "/bookmarks/"+id, "", 200)
+	if result["bookmarks"] != "" {
+		t.Fatalf("oversized sync was stored")
+	}
+
+	// anything under the limit is fine
+	sendJSON(t, h, "PUT", "/bookmarks/"+id, `{"bookmarks":"`+strings.Repeat("x", 512)+`"}`, 200)
+}
+
+func TestLastUpdated(t *testing.T) {
+	h := newTestServer(t, nil)
+	id, created := createSync(t, h)
+
+	result := sendJSON(t, h, "GET", "/bookmarks/"+id+"/lastUpdated", "", 200)
+	expectFields(t, result, "lastUpdated")
+	if result["lastUpdated"] != created {
+		t.Fatalf("lastUpdated %v, want %s", result["lastUpdated"], created)
+	}
+
+	updated := sendJSON(t, h, "PUT", "/bookmarks/"+id, `{"bookmarks":"data"}`, 200)
+	result = sendJSON(t, h, "GET", "/bookmarks/"+id+"/lastUpdated", "", 200)
+	if result["lastUpdated"] != updated["lastUpdated"] {
+		t.Fatalf("lastUpdated %v, want %v", result["lastUpdated"], updated["lastUpdated"])
+	}
+
+	expectError(t, h, "GET", "/bookmarks/"+unknownSyncID+"/lastUpdated", "", 401, codeInvalidSyncID)
+	expectError(t, h, "GET", "/bookmarks/not-a-sync-id/lastUpdated", "", 401, codeInvalidSyncID)
+}
+
+func TestVersion(t *testing.T) {
+	h := newTestServer(t, nil)
+	id, _ := createSync(t, h)
+
+	result := sendJSON(t, h, "GET", "/bookmarks/"+id+"/version", "", 200)
+	expectFields(t, result, "version")
+	if result["version"] != "1.5.2" {
+		t.Fatalf("version %v, want 1.5.2", result["version"])
+	}
+
+	expectError(t, h, "GET", "/bookmarks/"+unknownSyncID+"/version", "", 401, codeInvalidSyncID)
+	expectError(t, h, "GET", "/bookmarks/not-a-sync-id/version", "", 401, codeInvalidSyncID)
+}
+
+func TestInfo(t *testing.T) {
+	h := newTestServer(t, nil)
+
+	result := sendJSON(t, h, "GET", "/info", "", 200)
+	expectFields(t, result, "status", "message", "version", "buildstamp", "maxSyncSize")
+
+	if result["status"] != float64(serviceStatusOnline) {
+		t.Fatalf("status %v, want %d", result["status"], serviceStatusOnline)
+	}
+	if result["message"] != "testing" || result["buildstamp"] != "test-build" {
+		t.Fatalf("unexpected message or build stamp in %v", result)
+	}
+	if result["version"] != apiVersion() {
+		t.Fatalf("version %v, want %s", result["version"], apiVersion())
+	}
+	if result["maxSyncSize"] != float64(1024) {
+		t.Fatalf("maxSyncSize %v, want 1024", result["maxSyncSize"])
+	}
+}
+
+func TestInfoLocation(t *testing.T) {
+	h := newTestServer(t, func(c *Config) {
+		c.Location = "gb"
+	})
+
+	result := sendJSON(t, h, "GET", "/info", "", 200)
+	if result["location"] != "GB" {
+		t.Fatalf("location %v, want GB", result["location"])
+	}
+}
+
+func TestToggleNewSyncs(t *testing.T) {
+	h := newTestServer(t, nil)
+
+	status, body := send(t, h, "GET", testToggleRoute, "")
+	if status != 200 || body != "Toggled accept_new_syncs to [false]" {
+		t.Fatalf("toggle: status %d, body %q", status, body)
+	}
+
+	// closed for business; existing syncs carry on as normal
+	expectError(t, h, "POST", "/bookmarks", `{"version":"1.5.2"}`, 405, codeNewSyncsForbidden)
+	result := sendJSON(t, h, "GET", "/info", "", 200)
+	if result["status"] != float64(serviceStatusNoNewSyncs) {
+		t.Fatalf("status %v, want %d", result["status"], serviceStatusNoNewSyncs)
+	}
+
+	status, body = send(t, h, "GET", testToggleRoute, "")
+	if status != 200 || body != "Toggled accept_new_syncs to [true]" {
+		t.Fatalf("toggle: status %d, body %q", status, body)
+	}
+	createSync(t, h)
+}
+
+func TestToggleDisabled(t *testing.T) {
+	h := newTestServer(t, func(c *Config) {
+		c.SyncToggleRoute = ""
+	})
+
+	if status, _ := send(t, h, "GET", testToggleRoute, ""); status != 404 {
+		t.Fatalf("toggle route answered with %d when disabled", status)
+	}
+}
+
+func TestFrontAndStatusPages(t *testing.T) {
+	h := newTestServer(t, nil)
+	createSync(t, h)
+
+	status, body := send(t, h, "GET", "/", "")
+	if status != 200 || !strings.Contains(body, "<html") {
+		t.Fatalf("front page: status %d", status)
+	}
+	if strings.Contains(body, "key count") {
+		t.Fatalf("front page shows stats")
+	}
+
+	status, body = send(t, h, "GET", testStatusRoute, "")
+	if status != 200 || !strings.Contains(body, "key count") || !strings.Contains(body, "test-build") {
+		t.Fatalf("status page: status %d, body %s", status, body)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	h := newTestServer(t, func(c *Config) {
+		c.MetricsRoute = "/metrics"
+	})
+
+	id, _ := createSync(t, h)
+	sendJSON(t, h, "PUT", "/bookmarks/"+id, `{"bookmarks":"0123456789"}`, 200)
+	send(t, h, "GET", "/bookmarks/"+unknownSyncID, "")
+	send(t, h, "GET", testToggleRoute, "")
+	expectError(t, h, "POST", "/bookmarks", `{"version":"1.5.2"}`, 405, codeNewSyncsForbidden)
+
+	status, body := send(t, h, "GET", "/metrics", "")
+	if status != 200 {
+		t.Fatalf("metrics: status %d", status)
+	}
+	for _, want := range []string{
+		`xsyn_http_requests_total{method="PUT",route="/bookmarks/:id",status="200"} 1`,
+		`xsyn_http_requests_total{method="GET",route="/bookmarks/:id",status="401"} 1`,
+		`xsyn_http_requests_total{method="GET",route="sync_toggle_route",status="200"} 1`,
+		`xsyn_syncs_created_total 1`,
+		`xsyn_sync_bytes_written_total 10`,
+		`xsyn_new_syncs_rejected_total{reason="disabled"} 1`,
+		`xsyn_accepting_new_syncs 0`,
+		`xsyn_build_info{backend="memory",buildstamp="test-build"} 1`,
+		`xsyn_store_keys 1`,
+		`xsyn_store_size_bytes 10`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+	if strings.Contains(body, testToggleRoute) {
+		t.Errorf("metrics give away the toggle route")
+	}
+}
+
+func TestMetricsToken(t *testing.T) {
+	h := newTestServer(t, func(c *Config) {
+		c.MetricsRoute = "/metrics"
+		c.MetricsToken = "scrape"
+	})
+
+	expectError(t, h, "GET", "/metrics", "", 401, codeUnauthorized)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer scrape")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "xsyn_store_keys 0") {
+		t.Fatalf("metrics with token: status %d", w.Code)
+	}
+}
+
+func TestStatusJSON(t *testing.T) {
+	h := newTestServer(t, nil)
+	createSync(t, h)
+
+	req := httptest.NewRequest("GET", testStatusRoute, nil)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("status JSON: status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	expectFields(t, result, "keyCount", "sizeBytes", "backend", "buildStamp", "bootTime", "uptimeSeconds", "apiVersion", "acceptNewSyncs")
+	if result["keyCount"] != float64(1) || result["backend"] != "memory" || result["acceptNewSyncs"] != true {
+		t.Fatalf("unexpected status %v", result)
+	}
+}
+
+func TestStatusJSONBackends(t *testing.T) {
+	tests := []struct {
+		name  string
+		open  func(storageFile string) (store.Store, error)
+		field string
+	}{
+		{"bolt", func(storageFile string) (store.Store, error) {
+			return store.OpenBolt(storageFile, time.Second, store.HistoryPolicy{}, false)
+		}, "bolt"},
+		{"sqlite", func(storageFile string) (store.Store, error) {
+			return store.OpenSQLite(storageFile, time.Second, store.HistoryPolicy{}, false)
+		}, "sqlite"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			syncStore, err := tt.open(filepath.Join(t.TempDir(), "marks"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer syncStore.Close()
+			srv, err := New(Config{}, syncStore)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// each backend's numbers come under its own name, and nothing else's
+			report, _ := srv.buildStatusReport()
+			data, err := json.Marshal(report)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var result map[string]interface{}
+			if err = json.Unmarshal(data, &result); err != nil {
+				t.Fatal(err)
+			}
+			expectFields(t, result, "keyCount", "sizeBytes", "backend", "buildStamp", "bootTime", "uptimeSeconds", "apiVersion", "acceptNewSyncs", tt.field)
+		})
+	}
+}
+
+func TestRunStopsOnCancel(t *testing.T) {
+	srv, err := New(Config{Port: 0, ShutdownTimeout: time.Second}, store.NewMemory(store.HistoryPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Run(ctx)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run returned %v after cancel", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after cancel")
+	}
+}
+
+func TestNoNewSyncsConfig(t *testing.T) {
+	h := newTestServer(t, func(c *Config) {
+		c.NoNewSyncs = true
+	})
+
+	expectError(t, h, "POST", "/bookmarks", `{"version":"1.5.2"}`, 405, codeNewSyncsForbidden)
+	result := sendJSON(t, h, "GET", "/info", "", 200)
+	if result["status"] != float64(serviceStatusNoNewSyncs) {
+		t.Fatalf("status %v, want %d", result["status"], serviceStatusNoNewSyncs)
+	}
+}
+
+func TestToggleSurvivesRestart(t *testing.T) {
+	syncStore := store.NewMemory(store.HistoryPolicy{})
+	config := Config{SyncToggleRoute: testToggleRoute}
+
+	start := func(config Config) http.Handler {
+		srv, err := New(config, syncStore)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return srv.Handler()
+	}
+
+	h := start(config)
+	if status, _ := send(t, h, "GET", testToggleRoute, ""); status != 200 {
+		t.Fatalf("toggle: status %d", status)
+	}
+
+	// the same config again picks up where we left off
+	h = start(config)
+	expectError(t, h, "POST", "/bookmarks", `{"version":"1.5.2"}`, 405, codeNewSyncsForbidden)
+
+	// but changing the config overrides the toggle
+	config.NoNewSyncs = true
+	h = start(config)
+	expectError(t, h, "POST", "/bookmarks", `{"version":"1.5.2"}`, 405, codeNewSyncsForbidden)
+	config.NoNewSyncs = false
+	h = start(config)
+	createSync(t, h)
+}
+
+func TestMaxSyncs(t *testing.T) {
+	h := newTestServer(t, func(c *Config) {
+		c.MaxSyncs = 1
+	})
+
+	result := sendJSON(t, h, "GET", "/info", "", 200)
+	if result["status"] != float64(serviceStatusOnline) {
+		t.Fatalf("status %v before the limit, want %d", result["status"], serviceStatusOnline)
+	}
+
+	createSync(t, h)
+
+	// the message says which limit, rather than the usual one for the code
+	result = sendJSON(t, h, "POST", "/bookmarks", `{"version":"1.5.2"}`, 406)
+	if result["code"] != codeNewSyncsLimitExceeded || !strings.Contains(result["message"].(string), "limit of 1 syncs") {
+		t.Fatalf("unexpected error %v", result)
+	}
+
+	result = sendJSON(t, h, "GET", "/info", "", 200)
+	if result["status"] != float64(serviceStatusNoNewSyncs) {
+		t.Fatalf("status %v at the limit, want %d", result["status"], serviceStatusNoNewSyncs)
+	}
+	if message := result["message"].(string); !strings.HasPrefix(message, "testing") || !strings.Contains(message, "limit of 1 syncs") {
+		t.Fatalf("message %q doesn't explain the limit", message)
+	}
+}
+
+func TestInviteOnly(t *testing.T) {
+	syncStore := store.NewMemory(store.HistoryPolicy{})
+	srv, err := New(Config{InviteOnly: true, AdminToken: "admin"}, syncStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := srv.Handler()
+
+	expectError(t, h, "POST", "/bookmarks", `{"version":"1.5.2"}`, 403, codeInviteRequired)
+	result := sendJSON(t, h, "GET", "/info", "", 200)
+	if result["status"] != float64(serviceStatusNoNewSyncs) {
+		t.Fatalf("status %v, want %d", result["status"], serviceStatusNoNewSyncs)
+	}
+
+	// make a code good for two syncs through the admin API
+	req := httptest.NewRequest("POST", "/admin/invites", strings.NewReader(`{"maxUses":2,"note":"testing"}`))
+	req.Header.Set("Authorization", "Bearer admin")
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 201 {
+		t.Fatalf("create invite: status %d; body %s", w.Code, w.Body.String())
+	}
+	var invite store.Invite
+	if err := json.Unmarshal(w.Body.Bytes(), &invite); err != nil || len(invite.Code) != 14 {
+		t.Fatalf("create invite: %v %+v", err, invite)
+	}
+
+	// once in the body, typed carelessly, and once in the header
+	sendJSON(t, h, "POST", "/bookmarks", `{"version":"1.5.2","inviteCode":"`+strings.ToLower(strings.ReplaceAll(invite.Code, "-", ""))+`"}`, 200)
+
+	req = httptest.NewRequest("POST", "/bookmarks", strings.NewReader(`{"version":"1.5.2"}`))
+	req.Header.Set(inviteCodeHeader, invite.Code)
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("invite in header: status %d; body %s", w.Code, w.Body.String())
+	}
+
+	result = sendJSON(t, h, "POST", "/bookmarks", `{"version":"1.5.2","inviteCode":"`+invite.Code+`"}`, 403)
+	if result["code"] != codeInvalidInvite || result["message"] != inviteErrorMessage[store.ErrInviteUsedUp] {
+		t.Fatalf("used up invite: %v", result)
+	}
+	expectError(t, h, "POST", "/bookmarks", `{"version":"1.5.2","inviteCode":"AAAA-BBBB-CCCC"}`, 403, codeInvalidInvite)
+
+	invites, err := syncStore.Invites()
+	if err != nil || len(invites) != 1 || invites[0].Uses != 2 || len(invites[0].LastUsed) == 0 {
+		t.Fatalf("invites %+v, %v", invites, err)
+	}
+}
+
+// failingCreateStore can't create sync IDs, for checking what's handed back when that fails
+type failingCreateStore struct {
+	store.Store
+}
+
+func (s failingCreateStore) CreateSync(clientVersion string) (string, string, error) {
+	return "", "", errors.New("disk full")
+}
+
+func TestInviteHandedBackOnFailure(t *testing.T) {
+	syncStore := store.NewMemory(store.HistoryPolicy{})
+	invite, err := store.NewInvite(1, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = syncStore.CreateInvite(invite); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := New(Config{InviteOnly: true, NewSyncsPerHour: 1}, failingCreateStore{syncStore})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := srv.Handler()
+
+	// twice, as the one use the invite has, and the one place this hour, are both handed back
+	for i := 0; i < 2; i++ {
+		expectError(t, h, "POST", "/bookmarks", `{"version":"1.5.2","inviteCode":"`+invite.Code+`"}`, 500, codeUnspecifiedError)
+	}
+
+	invites, err := syncStore.Invites()
+	if err != nil || len(invites) != 1 || invites[0].Uses != 0 {
+		t.Fatalf("invites %+v, %v", invites, err)
+	}
+	if closed := srv.newSyncsClosed(); closed != nil {
+		t.Fatalf("closed after failing to create: %s", closed.message)
+	}
+}
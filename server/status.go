@@ -0,0 +1,164 @@
+package server
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * the server's status as JSON, for monitoring tools; the status route hands
+ * this out instead of the HTML page to anything that asks for JSON in its
+ * Accept header, and /admin/stats returns it too, with the store's raw
+ * details added on
+ *
+ * these field names are kept stable, unlike the HTML page which shows
+ * whatever the store and its database library happen to report
+ *
+ */
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ishani/xSyn/store"
+	"go.uber.org/zap"
+)
+
+// statusReport is the JSON form of the status page
+type statusReport struct {
+	KeyCount       int       `json:"keyCount"`
+	SizeBytes      int64     `json:"sizeBytes"`
+	Backend        string    `json:"backend"`
+	BuildStamp     string    `json:"buildStamp"`
+	BootTime       time.Time `json:"bootTime"`
+	UptimeSeconds  int64     `json:"uptimeSeconds"`
+	APIVersion     string    `json:"apiVersion"`
+	AcceptNewSyncs bool      `json:"acceptNewSyncs"`
+
+	// why new syncs are being turned away, if they are (see limits.go for the reasons), and
+	// whether they need an invite code
+	NewSyncsClosed string `json:"newSyncsClosed,omitempty"`
+	InviteOnly     bool   `json:"inviteOnly,omitempty"`
+
+	// the backend's own numbers, as also served to Prometheus; only the one matching the
+	// backend is filled in, and the in-memory store has none
+	Bolt       *boltStatus   `json:"bolt,omitempty"`
+	SQLite     *sqliteStatus `json:"sqlite,omitempty"`
+	StoreError string        `json:"storeError,omitempty"`
+
+	Pruning *pruneSummary  `json:"pruning,omitempty"`
+	Backups *backupSummary `json:"backups,omitempty"`
+}
+
+// boltStatus is Bolt's freelist, and its transaction counts; those ending in Total are running
+// totals since the file was opened
+type boltStatus struct {
+	FreePages               int64   `json:"freePages"`
+	PendingPages            int64   `json:"pendingPages"`
+	FreeAllocBytes          int64   `json:"freeAllocBytes"`
+	FreelistInuseBytes      int64   `json:"freelistInuseBytes"`
+	ReadTxTotal             int64   `json:"readTxTotal"`
+	OpenReadTx              int64   `json:"openReadTx"`
+	TxPageAllocsTotal       int64   `json:"txPageAllocsTotal"`
+	TxPageAllocBytesTotal   int64   `json:"txPageAllocBytesTotal"`
+	TxCursorsTotal          int64   `json:"txCursorsTotal"`
+	TxNodesTotal            int64   `json:"txNodesTotal"`
+	TxNodeDerefsTotal       int64   `json:"txNodeDerefsTotal"`
+	TxRebalancesTotal       int64   `json:"txRebalancesTotal"`
+	TxRebalanceSecondsTotal float64 `json:"txRebalanceSecondsTotal"`
+	TxSplitsTotal           int64   `json:"txSplitsTotal"`
+	TxSpillsTotal           int64   `json:"txSpillsTotal"`
+	TxSpillSecondsTotal     float64 `json:"txSpillSecondsTotal"`
+	TxWritesTotal           int64   `json:"txWritesTotal"`
+	TxWriteSecondsTotal     float64 `json:"txWriteSecondsTotal"`
+}
+
+// sqliteStatus is the state of the SQLite connection pool, and the database's free pages
+type sqliteStatus struct {
+	FreePages        int64   `json:"freePages"`
+	OpenConnections  int64   `json:"openConnections"`
+	InUseConnections int64   `json:"inUseConnections"`
+	IdleConnections  int64   `json:"idleConnections"`
+	WaitsTotal       int64   `json:"waitsTotal"`
+	WaitSecondsTotal float64 `json:"waitSecondsTotal"`
+}
+
+// storeStatus sorts the backend's metrics, named as they are for Prometheus, into the fixed
+// fields of the status JSON
+func (r *statusReport) storeStatus(backend string, metrics map[string]float64) {
+
+	count := func(name string) int64 { return int64(metrics[name]) }
+
+	switch backend {
+	case "bolt":
+		r.Bolt = &boltStatus{
+			FreePages:               count("free_pages"),
+			PendingPages:            count("pending_pages"),
+			FreeAllocBytes:          count("free_alloc_bytes"),
+			FreelistInuseBytes:      count("freelist_inuse_bytes"),
+			ReadTxTotal:             count("read_tx_total"),
+			OpenReadTx:              count("open_read_tx"),
+			TxPageAllocsTotal:       count("tx_page_allocs_total"),
+			TxPageAllocBytesTotal:   count("tx_page_alloc_bytes_total"),
+			TxCursorsTotal:          count("tx_cursors_total"),
+			TxNodesTotal:            count("tx_nodes_total"),
+			TxNodeDerefsTotal:       count("tx_node_derefs_total"),
+			TxRebalancesTotal:       count("tx_rebalances_total"),
+			TxRebalanceSecondsTotal: metrics["tx_rebalance_seconds_total"],
+			TxSplitsTotal:           count("tx_splits_total"),
+			TxSpillsTotal:           count("tx_spills_total"),
+			TxSpillSecondsTotal:     metrics["tx_spill_seconds_total"],
+			TxWritesTotal:           count("tx_writes_total"),
+			TxWriteSecondsTotal:     metrics["tx_write_seconds_total"],
+		}
+	case "sqlite":
+		r.SQLite = &sqliteStatus{
+			FreePages:        count("free_pages"),
+			OpenConnections:  count("open_connections"),
+			InUseConnections: count("in_use_connections"),
+			IdleConnections:  count("idle_connections"),
+			WaitsTotal:       count("waits_total"),
+			WaitSecondsTotal: metrics["wait_seconds_total"],
+		}
+	}
+}
+
+// buildStatusReport gathers up the status, also returning the store's stats it was built
+// from; if the store can't report them, we still return the rest, with the reason in StoreError
+func (s *Server) buildStatusReport() (*statusReport, *store.Stats) {
+
+	report := &statusReport{
+		Backend:        s.store.Backend(),
+		BuildStamp:     s.config.BuildStamp,
+		BootTime:       s.bootTime,
+		UptimeSeconds:  int64(time.Since(s.bootTime).Seconds()),
+		APIVersion:     apiVersion(),
+		AcceptNewSyncs: s.newSyncsAllowed.Load(),
+		InviteOnly:     s.config.InviteOnly,
+	}
+	if closed := s.newSyncsClosed(); closed != nil {
+		report.NewSyncsClosed = closed.name
+	}
+
+	stats, err := s.store.Stats()
+	if err != nil {
+		zLog.Warn("Store stats", zap.Error(err))
+		report.StoreError = err.Error()
+	} else {
+		report.KeyCount = stats.KeyCount
+		report.SizeBytes = stats.SizeBytes
+		report.storeStatus(report.Backend, stats.Metrics)
+	}
+
+	if s.syncPruner != nil {
+		summary := s.syncPruner.summary()
+		report.Pruning = &summary
+	}
+	if s.backups != nil {
+		summary := s.backups.summary()
+		report.Backups = &summary
+	}
+	return report, stats
+}
+
+// wantsJSON checks the Accept header, preferring HTML when the client doesn't mind either way
+func wantsJSON(c *gin.Context) bool {
+	c.Header("Vary", "Accept")
+	return c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) == gin.MIMEJSON
+}
@@ -0,0 +1,90 @@
+package main
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * picking and opening the storage backend named in the config; the
+ * backends themselves live in the store package
+ *
+ */
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ishani/xSyn/store"
+)
+
+// openStore opens whichever storage backend the config asks for; readOnly is for tools
+// that only want to look, and fails rather than creating or migrating anything
+func openStore(readOnly bool) (store.Store, error) {
+
+	history := store.HistoryPolicy{
+		Revisions: int(AppConfig.History.Revisions),
+		MaxAge:    time.Hour * 24 * time.Duration(AppConfig.History.MaxAgeDays),
+	}
+
+	switch AppConfig.Storage.Backend {
+
+	case "", "bolt":
+		return store.OpenBolt(
+			AppConfig.Bolt.StorageFile,
+			time.Second*time.Duration(AppConfig.Bolt.InitTimeout),
+			history,
+			readOnly,
+		)
+
+	case "sqlite":
+		return store.OpenSQLite(
+			AppConfig.SQLite.StorageFile,
+			time.Second*time.Duration(AppConfig.SQLite.BusyTimeout),
+			history,
+			readOnly,
+		)
+
+	case "memory":
+		zLog.Warn("Using in-memory storage; nothing will be saved")
+		return store.NewMemory(history), nil
+	}
+
+	return nil, fmt.Errorf("unknown storage backend [%s]", AppConfig.Storage.Backend)
+}
+
+// compactStore shrinks the configured backend's file down to the data it actually holds
+func compactStore() error {
+
+	switch storeBackendName() {
+
+	case "bolt":
+		return store.CompactBolt(
+			AppConfig.Bolt.StorageFile,
+			time.Second*time.Duration(AppConfig.Bolt.InitTimeout),
+		)
+
+	case "sqlite":
+		return store.CompactSQLite(
+			AppConfig.SQLite.StorageFile,
+			time.Second*time.Duration(AppConfig.SQLite.BusyTimeout),
+		)
+	}
+
+	return store.ErrNotSupported
+}
+
+// storeFileName is the path of the configured backend's file, or "" if it doesn't have one
+func storeFileName() string {
+	switch storeBackendName() {
+	case "bolt":
+		return AppConfig.Bolt.StorageFile
+	case "sqlite":
+		return AppConfig.SQLite.StorageFile
+	}
+	return ""
+}
+
+// storeBackendName is the name of the configured backend, with the default filled in
+func storeBackendName() string {
+	if len(AppConfig.Storage.Backend) == 0 {
+		return "bolt"
+	}
+	return AppConfig.Storage.Backend
+}
@@ -0,0 +1,223 @@
+package store
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * backups of the live store, taken without stopping the server; each one is
+ * a snapshot in the backend's own file format (optionally gzipped) with a
+ * small JSON manifest beside it, recording what went in and a checksum of
+ * the file so that it can be checked before being restored
+ *
+ * the server takes these on a schedule or through the admin API, and the
+ * restore command reads them back
+ *
+ */
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackupManifestSuffix is added to a backup's name to give the name of its manifest, which lives beside it
+const BackupManifestSuffix = ".manifest.json"
+
+// BackupManifest describes a single backup file
+type BackupManifest struct {
+	File         string `json:"file"`
+	Backend      string `json:"backend"`
+	Created      string `json:"created"`
+	BuildStamp   string `json:"buildStamp"`
+	Compressed   bool   `json:"compressed"`
+	Size         int64  `json:"size"`         // of the file as written, compressed or not
+	SnapshotSize int64  `json:"snapshotSize"` // of the snapshot itself
+	KeyCount     int    `json:"keyCount"`
+	SHA256       string `json:"sha256"` // of the file as written
+}
+
+// backupFileName picks a name for a backup taken at the given time, to the millisecond; these sort by age
+func backupFileName(backend string, now time.Time, compress bool) string {
+	extension := ".db"
+	if backend == "sqlite" {
+		extension = ".sqlite"
+	}
+	name := fmt.Sprintf("xsyn-%s%s", now.UTC().Format("20060102-150405.000"), extension)
+	if compress {
+		name += ".gz"
+	}
+	return name
+}
+
+// WriteBackup takes a snapshot of the store into a new file in the given directory, along
+// with its manifest; the file only appears under its proper name once it's complete.
+// buildStamp is recorded in the manifest, to show which build took it
+func WriteBackup(store Store, dir string, compress bool, buildStamp string) (*BackupManifest, error) {
+
+	now := time.Now().UTC()
+	manifest := BackupManifest{
+		Backend:    store.Backend(),
+		Created:    now.Format(TimestampFormat),
+		BuildStamp: buildStamp,
+		Compressed: compress,
+	}
+
+	// should another backup already have this name, finished or not, we move on a millisecond
+	// at a time until we find a free one; the names still sort in the order they were taken
+	var backupPath, partialPath string
+	var backupFile *os.File
+	for {
+		manifest.File = backupFileName(store.Backend(), now, compress)
+		backupPath = filepath.Join(dir, manifest.File)
+		partialPath = backupPath + ".partial"
+
+		var err error
+		backupFile, err = os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			now = now.Add(time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = os.Stat(backupPath); err == nil {
+			backupFile.Close()
+			os.Remove(partialPath)
+			now = now.Add(time.Millisecond)
+			continue
+		}
+		break
+	}
+
+	hasher := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(backupFile, hasher)}
+
+	snapshotInfo, err := writeSnapshot(store, counter, compress)
+	if err == nil {
+		err = backupFile.Sync()
+	}
+	if closeErr := backupFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(partialPath, backupPath)
+	}
+	if err != nil {
+		os.Remove(partialPath)
+		return nil, err
+	}
+
+	manifest.Size = counter.n
+	manifest.SnapshotSize = snapshotInfo.Size
+	manifest.KeyCount = snapshotInfo.KeyCount
+	manifest.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(backupPath+BackupManifestSuffix, manifestBytes, 0600); err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+// CheckSnapshot looks a snapshot over read-only, to be sure it holds sync IDs before it's
+// opened as a store; opening it read-write migrates it, which would turn a truncated or
+// foreign file into an empty store to restore from. backend is "bolt" or "sqlite"
+func CheckSnapshot(backend, snapshotFile string) error {
+
+	switch backend {
+	case "bolt":
+		return checkBoltSnapshot(snapshotFile)
+	case "sqlite":
+		return checkSQLiteSnapshot(snapshotFile)
+	}
+	return fmt.Errorf("unknown backend [%s]", backend)
+}
+
+// write a snapshot of the store to w, gzipping it on the way if asked
+func writeSnapshot(store Store, w io.Writer, compress bool) (*SnapshotInfo, error) {
+
+	if !compress {
+		return store.Backup(w)
+	}
+
+	gzWriter := gzip.NewWriter(w)
+	snapshotInfo, err := store.Backup(gzWriter)
+	if closeErr := gzWriter.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return snapshotInfo, nil
+}
+
+// countingWriter keeps a tally of the bytes passing through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// TrimBackups removes all but the newest 'keep' backups from the directory, manifests and all;
+// only files with a manifest are considered, so anything else in there is left alone
+func TrimBackups(dir string, keep int) ([]string, error) {
+
+	manifests, err := filepath.Glob(filepath.Join(dir, "xsyn-*"+BackupManifestSuffix))
+	if err != nil {
+		return nil, err
+	}
+	if keep <= 0 || len(manifests) <= keep {
+		return nil, nil
+	}
+
+	// names carry the time they were taken, so the oldest sort first
+	sort.Strings(manifests)
+
+	var removed []string
+	for _, manifestPath := range manifests[:len(manifests)-keep] {
+
+		backupPath := strings.TrimSuffix(manifestPath, BackupManifestSuffix)
+		if err := os.Remove(backupPath); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		if err := os.Remove(manifestPath); err != nil {
+			return removed, err
+		}
+		removed = append(removed, filepath.Base(backupPath))
+	}
+	return removed, nil
+}
+
+// ReadBackupManifest loads the manifest sitting beside a backup file, or returns nil if there isn't one
+func ReadBackupManifest(backupFile string) (*BackupManifest, error) {
+
+	manifestBytes, err := os.ReadFile(backupFile + BackupManifestSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest BackupManifest
+	if err = json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, fmt.Errorf("malformed manifest: %s", err)
+	}
+	return &manifest, nil
+}
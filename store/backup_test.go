@@ -0,0 +1,192 @@
+package store
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * backups, and the checks a snapshot has to pass before it's restored
+ *
+ */
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// writeTestBackup fills a store with a couple of sync IDs and an invite, and backs it up uncompressed
+func writeTestBackup(t *testing.T, s Store, dir string) string {
+	t.Helper()
+
+	id, _ := mustCreateSync(t, s)
+	mustPut(t, s, id, "one")
+	mustPut(t, s, id, "two")
+	mustCreateSync(t, s)
+
+	invite, err := NewInvite(1, 0, "for the backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.CreateInvite(invite); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := WriteBackup(s, dir, false, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.KeyCount != 2 {
+		t.Fatalf("manifest lists %d sync IDs, want 2", manifest.KeyCount)
+	}
+	return filepath.Join(dir, manifest.File)
+}
+
+// checkSnapshotRefused makes sure a file fails the check, and that the check left it as it was
+func checkSnapshotRefused(t *testing.T, backend, snapshotFile string) {
+	t.Helper()
+
+	before, err := os.ReadFile(snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckSnapshot(backend, snapshotFile); err == nil {
+		t.Fatalf("%s snapshot passed the check", backend)
+	}
+	after, err := os.ReadFile(snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatalf("checking the snapshot changed it")
+	}
+}
+
+// truncate copies the first part of a file somewhere else
+func truncate(t *testing.T, sourceFile, destFile string, size int) string {
+	t.Helper()
+
+	data, err := os.ReadFile(sourceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(destFile, data[:size], 0600); err != nil {
+		t.Fatal(err)
+	}
+	return destFile
+}
+
+func TestCheckBoltSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	backupFile := writeTestBackup(t, openTestBolt(t, filepath.Join(dir, "live.db"), conformanceHistory), dir)
+	if err := CheckSnapshot("bolt", backupFile); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(backupFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSnapshotRefused(t, "bolt", truncate(t, backupFile, filepath.Join(dir, "truncated.db"), int(info.Size()/2)))
+	checkSnapshotRefused(t, "bolt", truncate(t, backupFile, filepath.Join(dir, "header.db"), 100))
+
+	foreignFile := filepath.Join(dir, "foreign.db")
+	seedBolt(t, foreignFile, func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("something else"))
+		return err
+	})
+	checkSnapshotRefused(t, "bolt", foreignFile)
+
+	// says it's at the current version, but has lost its history bucket
+	partialFile := filepath.Join(dir, "partial.db")
+	seedBolt(t, partialFile, func(tx *bolt.Tx) error {
+		if err := migrateBoltToV1(tx); err != nil {
+			return err
+		}
+		for version := uint64(2); version <= boltSchemaVersion; version++ {
+			if err := boltMigrations[version](tx); err != nil {
+				return err
+			}
+		}
+		meta, err := tx.CreateBucket(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		if err = meta.Put(boltSchemaKey, []byte{0, 0, 0, 0, 0, 0, 0, boltSchemaVersion}); err != nil {
+			return err
+		}
+		return tx.DeleteBucket(boltHistoryBucket)
+	})
+	checkSnapshotRefused(t, "bolt", partialFile)
+
+	// older files are fine, they're migrated once they've passed
+	v1File := filepath.Join(dir, "v1.db")
+	seedBolt(t, v1File, migrateBoltToV1)
+	if err = CheckSnapshot("bolt", v1File); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckSQLiteSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	backupFile := writeTestBackup(t, openTestSQLite(t, filepath.Join(dir, "live.sqlite"), conformanceHistory, false), dir)
+	if err := CheckSnapshot("sqlite", backupFile); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(backupFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSnapshotRefused(t, "sqlite", truncate(t, backupFile, filepath.Join(dir, "truncated.sqlite"), int(info.Size()/2)))
+
+	foreignFile := filepath.Join(dir, "foreign.sqlite")
+	s := openTestSQLite(t, foreignFile, HistoryPolicy{}, false)
+	if _, err = s.db.Exec(`DROP TABLE syncs; PRAGMA user_version = 0`); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	checkSnapshotRefused(t, "sqlite", foreignFile)
+
+	checkSnapshotRefused(t, "memory", backupFile)
+}
+
+func TestWriteBackupBackToBack(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestBolt(t, filepath.Join(dir, "live.db"), HistoryPolicy{})
+	mustCreateSync(t, s)
+
+	// quicker than the clock ticks over, more often than not
+	var files []string
+	for i := 0; i < 5; i++ {
+		manifest, err := WriteBackup(s, dir, false, "test")
+		if err != nil {
+			t.Fatalf("backup %d: %s", i, err)
+		}
+		files = append(files, manifest.File)
+	}
+
+	for i, file := range files {
+		manifest, err := ReadBackupManifest(filepath.Join(dir, file))
+		if err != nil || manifest == nil || manifest.File != file {
+			t.Fatalf("manifest for %s is %+v, %v", file, manifest, err)
+		}
+		if i > 0 && file <= files[i-1] {
+			t.Fatalf("%s doesn't sort after %s", file, files[i-1])
+		}
+	}
+
+	// and trimming keeps the newest
+	removed, err := TrimBackups(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 4 {
+		t.Fatalf("trimmed %v", removed)
+	}
+	if _, err = os.Stat(filepath.Join(dir, files[4])); err != nil {
+		t.Fatalf("newest backup was trimmed: %v", err)
+	}
+}
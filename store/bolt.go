@@ -0,0 +1,769 @@
+package store
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * BoltDB implementation of the Store; each sync ID maps to a single
+ * JSON-encoded record in the records bucket, so a record is always
+ * written (or not) as a whole
+ *
+ * previous revisions live in the history bucket, which holds a nested bucket
+ * per sync ID, keyed by a big-endian revision number so they iterate in order
+ *
+ */
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/fatih/structs"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// names for buckets where we hide our data
+var boltRecordBucket = []byte("SR")
+var boltHistoryBucket = []byte("HI")
+var boltSettingsBucket = []byte("ST")
+var boltInviteBucket = []byte("IN")
+
+// boltRecordSchema is written into each record alongside the data, so that if the
+// record layout has to change in ways JSON can't absorb, we can tell old from new
+const boltRecordSchema = 1
+
+// boltRecord is a SyncRecord as it's serialized into the records bucket
+type boltRecord struct {
+	Schema int `json:"schema"`
+	SyncRecord
+}
+
+type boltStore struct {
+	db      *bolt.DB
+	history HistoryPolicy
+}
+
+// OpenBolt opens or creates the Bolt DB storage file, migrating it to the current schema if required;
+// readOnly opens the file with a shared lock, so several readers can look at it at once, but
+// never alongside a writer (like the server) - and it must already exist, at the current schema
+func OpenBolt(storageFile string, initTimeout time.Duration, history HistoryPolicy, readOnly bool) (Store, error) {
+
+	db, err := bolt.Open(
+		storageFile,
+		0600,
+		&bolt.Options{Timeout: initTimeout, ReadOnly: readOnly},
+	)
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("timed out waiting for [%s] to unlock; is something else using it?", storageFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// ensure the bucket collection exists and is laid out how we expect; a read-only
+	// file can't be migrated, so we can only check it's already up to date
+	if readOnly {
+		err = checkBoltSchema(db)
+	} else {
+		err = migrateBoltSchema(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if !readOnly {
+		db.Sync()
+	}
+	if _, err := os.Stat(storageFile); os.IsNotExist(err) {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db, history: history}, nil
+}
+
+// decode a record from the bucket, or return ErrSyncNotFound if there isn't one
+func getBoltRecord(bkRecords *bolt.Bucket, id []byte) (*SyncRecord, error) {
+
+	data := bkRecords.Get(id)
+	if data == nil {
+		return nil, ErrSyncNotFound
+	}
+
+	var record boltRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return &record.SyncRecord, nil
+}
+
+// encode a record into the bucket, stamping the record schema and size as we go
+func putBoltRecord(bkRecords *bolt.Bucket, id []byte, record *SyncRecord) error {
+
+	record.Size = len(record.Bookmarks)
+
+	data, err := json.Marshal(boltRecord{Schema: boltRecordSchema, SyncRecord: *record})
+	if err != nil {
+		return err
+	}
+	return bkRecords.Put(id, data)
+}
+
+// history buckets are keyed by revision number, big-endian so that they sort numerically
+func boltRevisionKey(revision uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, revision)
+	return key
+}
+
+// replaceBookmarks moves the record's current bookmarks into its history, then updates the
+// record with the new bookmarks and timestamp; the history is trimmed to the policy as we go
+func (s *boltStore) replaceBookmarks(tx *bolt.Tx, id []byte, record *SyncRecord, bookmarks, imprintTime string) error {
+
+	bkHistory := tx.Bucket(boltHistoryBucket)
+
+	// a freshly created sync ID has nothing worth keeping
+	if s.history.Revisions > 0 && len(record.Bookmarks) > 0 {
+
+		bkIDHistory, err := bkHistory.CreateBucketIfNotExists(id)
+		if err != nil {
+			return err
+		}
+
+		revision, _ := bkIDHistory.NextSequence()
+		data, err := json.Marshal(SyncRevision{
+			Revision:    revision,
+			Bookmarks:   record.Bookmarks,
+			LastUpdated: record.LastUpdated,
+			Replaced:    imprintTime,
+			Size:        record.Size,
+		})
+		if err != nil {
+			return err
+		}
+		if err = bkIDHistory.Put(boltRevisionKey(revision), data); err != nil {
+			return err
+		}
+	}
+
+	if err := s.trimHistory(bkHistory, id); err != nil {
+		return err
+	}
+
+	record.Bookmarks = bookmarks
+	record.LastUpdated = imprintTime
+	return putBoltRecord(tx.Bucket(boltRecordBucket), id, record)
+}
+
+// trimHistory drops whichever revisions of a sync ID the history policy says we no longer keep
+func (s *boltStore) trimHistory(bkHistory *bolt.Bucket, id []byte) error {
+
+	bkIDHistory := bkHistory.Bucket(id)
+	if bkIDHistory == nil {
+		return nil
+	}
+
+	revisions, err := listBoltRevisions(bkIDHistory)
+	if err != nil {
+		return err
+	}
+
+	retained := s.history.retained(revisions)
+	if retained == 0 {
+		return bkHistory.DeleteBucket(id)
+	}
+	for _, revision := range revisions[retained:] {
+		if err = bkIDHistory.Delete(boltRevisionKey(revision.Revision)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decode all the revisions in a history bucket, newest first, without their bookmarks data
+func listBoltRevisions(bkIDHistory *bolt.Bucket) ([]SyncRevision, error) {
+
+	revisions := make([]SyncRevision, 0)
+
+	cursor := bkIDHistory.Cursor()
+	for key, data := cursor.Last(); key != nil; key, data = cursor.Prev() {
+
+		var revision SyncRevision
+		if err := json.Unmarshal(data, &revision); err != nil {
+			return nil, err
+		}
+		revision.Bookmarks = ""
+		revisions = append(revisions, revision)
+	}
+	return revisions, nil
+}
+
+func (s *boltStore) CreateSync(clientVersion string) (string, string, error) {
+
+	newID := "invalid"
+	imprintTime := createTimestampString()
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+
+		bkRecords := tx.Bucket(boltRecordBucket)
+
+		// fetch a new ID from the bucket
+		seqID, _ := bkRecords.NextSequence()
+
+		var err error
+		newID, err = generateSyncID(seqID, func(id []byte) bool {
+			return bkRecords.Get(id) != nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return putBoltRecord(bkRecords, []byte(newID), &SyncRecord{
+			LastUpdated:  imprintTime,
+			Version:      clientVersion,
+			Created:      imprintTime,
+			LastAccessed: imprintTime,
+		})
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return newID, imprintTime, nil
+}
+
+func (s *boltStore) Get(id string) (*SyncRecord, error) {
+
+	record, err := s.Peek(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if needsTouch(record.LastAccessed) {
+		s.touch(id)
+	}
+	return record, nil
+}
+
+func (s *boltStore) Peek(id string) (*SyncRecord, error) {
+
+	var record *SyncRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+
+		var err error
+		record, err = getBoltRecord(tx.Bucket(boltRecordBucket), []byte(id))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// touch updates the lastAccessed time of a record; this is best-effort bookkeeping, so
+// failures are logged rather than failing the read that triggered it
+func (s *boltStore) touch(id string) {
+	markIDBytes := []byte(id)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+
+		bkRecords := tx.Bucket(boltRecordBucket)
+
+		record, err := getBoltRecord(bkRecords, markIDBytes)
+		if err != nil {
+			return err
+		}
+
+		record.LastAccessed = createTimestampString()
+		return putBoltRecord(bkRecords, markIDBytes, record)
+	})
+	if err != nil && err != ErrSyncNotFound {
+		zLog.Warn("Failed to update lastAccessed", zap.Error(err))
+	}
+}
+
+func (s *boltStore) Put(id, bookmarks, expectedLastUpdated string) (string, error) {
+	markIDBytes := []byte(id)
+
+	var imprintTime string
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+
+		bkRecords := tx.Bucket(boltRecordBucket)
+
+		// only existing syncs can be updated; new ones come through CreateSync
+		record, err := getBoltRecord(bkRecords, markIDBytes)
+		if err != nil {
+			return err
+		}
+
+		// if the client told us which lastUpdated it synced against, only accept the write
+		// if that's still what we have stored; otherwise another client got here first and
+		// we would be silently throwing their changes away
+		if len(expectedLastUpdated) > 0 {
+			if !TimestampsMatch(record.LastUpdated, expectedLastUpdated) {
+				return ErrSyncConflict
+			}
+		}
+
+		imprintTime = nextTimestampString(record.LastUpdated)
+
+		return s.replaceBookmarks(tx, markIDBytes, record, bookmarks, imprintTime)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return imprintTime, nil
+}
+
+func (s *boltStore) PutRecord(id string, record *SyncRecord) error {
+	markIDBytes := []byte(id)
+	written := *record
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+
+		bkRecords := tx.Bucket(boltRecordBucket)
+
+		existing, err := getBoltRecord(bkRecords, markIDBytes)
+		if err == ErrSyncNotFound {
+			return putBoltRecord(bkRecords, markIDBytes, &written)
+		}
+		if err != nil {
+			return err
+		}
+
+		// archive what's there first, then overwrite the lot
+		if err = s.replaceBookmarks(tx, markIDBytes, existing, written.Bookmarks, createTimestampString()); err != nil {
+			return err
+		}
+		return putBoltRecord(bkRecords, markIDBytes, &written)
+	})
+}
+
+func (s *boltStore) LastUpdated(id string) (string, error) {
+	record, err := s.Get(id)
+	if err != nil {
+		return "", err
+	}
+	return record.LastUpdated, nil
+}
+
+func (s *boltStore) Version(id string) (string, error) {
+
+	var result string
+	err := s.db.View(func(tx *bolt.Tx) error {
+
+		record, err := getBoltRecord(tx.Bucket(boltRecordBucket), []byte(id))
+		if err != nil {
+			return err
+		}
+		result = record.Version
+		return nil
+	})
+
+	return result, err
+}
+
+func (s *boltStore) Stats() (*Stats, error) {
+
+	// snag the bolt stats; break the TxStats map out
+	// because the template formatter is only expecting 2 levels of iteration
+	boltStats := s.db.Stats()
+	dbStats := structs.Map(boltStats)
+	txStats := dbStats["TxStats"]
+	dbStats["TxStats"] = "..."
+
+	result := Stats{
+		Details: map[string]interface{}{
+			"Bolt-Db":      dbStats,
+			"Bolt-TxStats": txStats,
+		},
+		Metrics: boltMetrics(&boltStats),
+	}
+
+	// get some more bits via transaction
+	err := s.db.View(func(tx *bolt.Tx) error {
+
+		bkRecords := tx.Bucket(boltRecordBucket)
+		result.KeyCount = bkRecords.Stats().KeyN
+		result.SizeBytes = tx.Size()
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// boltMetrics picks the numbers out of bolt's stats; TxStats is a running total of
+// every transaction since the database was opened
+func boltMetrics(stats *bolt.Stats) map[string]float64 {
+	tx := &stats.TxStats
+	return map[string]float64{
+		"free_pages":                 float64(stats.FreePageN),
+		"pending_pages":              float64(stats.PendingPageN),
+		"free_alloc_bytes":           float64(stats.FreeAlloc),
+		"freelist_inuse_bytes":       float64(stats.FreelistInuse),
+		"read_tx_total":              float64(stats.TxN),
+		"open_read_tx":               float64(stats.OpenTxN),
+		"tx_page_allocs_total":       float64(tx.GetPageCount()),
+		"tx_page_alloc_bytes_total":  float64(tx.GetPageAlloc()),
+		"tx_cursors_total":           float64(tx.GetCursorCount()),
+		"tx_nodes_total":             float64(tx.GetNodeCount()),
+		"tx_node_derefs_total":       float64(tx.GetNodeDeref()),
+		"tx_rebalances_total":        float64(tx.GetRebalance()),
+		"tx_rebalance_seconds_total": tx.GetRebalanceTime().Seconds(),
+		"tx_splits_total":            float64(tx.GetSplit()),
+		"tx_spills_total":            float64(tx.GetSpill()),
+		"tx_spill_seconds_total":     tx.GetSpillTime().Seconds(),
+		"tx_writes_total":            float64(tx.GetWrite()),
+		"tx_write_seconds_total":     tx.GetWriteTime().Seconds(),
+	}
+}
+
+func (s *boltStore) Each(fn func(id string, record *SyncRecord) error) error {
+
+	return s.db.View(func(tx *bolt.Tx) error {
+
+		return tx.Bucket(boltRecordBucket).ForEach(func(id, data []byte) error {
+
+			var record boltRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			return fn(string(id), &record.SyncRecord)
+		})
+	})
+}
+
+func (s *boltStore) History(id string) ([]SyncRevision, error) {
+	markIDBytes := []byte(id)
+
+	var revisions []SyncRevision
+	err := s.db.View(func(tx *bolt.Tx) error {
+
+		if tx.Bucket(boltRecordBucket).Get(markIDBytes) == nil {
+			return ErrSyncNotFound
+		}
+
+		bkIDHistory := tx.Bucket(boltHistoryBucket).Bucket(markIDBytes)
+		if bkIDHistory == nil {
+			revisions = make([]SyncRevision, 0)
+			return nil
+		}
+
+		var err error
+		revisions, err = listBoltRevisions(bkIDHistory)
+		if err == nil {
+			revisions = revisions[:s.history.retained(revisions)]
+		}
+		return err
+	})
+
+	return revisions, err
+}
+
+// fetch a single revision from the history bucket, as long as it hasn't expired
+func (s *boltStore) getRevision(tx *bolt.Tx, id []byte, revision uint64) (*SyncRevision, error) {
+
+	if tx.Bucket(boltRecordBucket).Get(id) == nil {
+		return nil, ErrSyncNotFound
+	}
+
+	bkIDHistory := tx.Bucket(boltHistoryBucket).Bucket(id)
+	if bkIDHistory == nil {
+		return nil, ErrRevisionNotFound
+	}
+
+	data := bkIDHistory.Get(boltRevisionKey(revision))
+	if data == nil {
+		return nil, ErrRevisionNotFound
+	}
+
+	var result SyncRevision
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	if s.history.expired(&result) {
+		return nil, ErrRevisionNotFound
+	}
+	return &result, nil
+}
+
+func (s *boltStore) Revision(id string, revision uint64) (*SyncRevision, error) {
+
+	var result *SyncRevision
+	err := s.db.View(func(tx *bolt.Tx) error {
+
+		var err error
+		result, err = s.getRevision(tx, []byte(id), revision)
+		return err
+	})
+
+	return result, err
+}
+
+func (s *boltStore) RollBack(id string, revision uint64) (string, error) {
+	markIDBytes := []byte(id)
+
+	var imprintTime string
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+
+		previous, err := s.getRevision(tx, markIDBytes, revision)
+		if err != nil {
+			return err
+		}
+
+		record, err := getBoltRecord(tx.Bucket(boltRecordBucket), markIDBytes)
+		if err != nil {
+			return err
+		}
+
+		imprintTime = nextTimestampString(record.LastUpdated)
+
+		return s.replaceBookmarks(tx, markIDBytes, record, previous.Bookmarks, imprintTime)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return imprintTime, nil
+}
+
+// deleteBoltSync removes a sync ID's record and history, which must exist
+func deleteBoltSync(tx *bolt.Tx, id []byte) error {
+
+	bkHistory := tx.Bucket(boltHistoryBucket)
+	if bkHistory.Bucket(id) != nil {
+		if err := bkHistory.DeleteBucket(id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket(boltRecordBucket).Delete(id)
+}
+
+func (s *boltStore) Delete(id string) error {
+	markIDBytes := []byte(id)
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+
+		if tx.Bucket(boltRecordBucket).Get(markIDBytes) == nil {
+			return ErrSyncNotFound
+		}
+		return deleteBoltSync(tx, markIDBytes)
+	})
+}
+
+func (s *boltStore) DeleteIfInactive(id string, cutoff time.Time) (bool, error) {
+	markIDBytes := []byte(id)
+
+	deleted := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+
+		record, err := getBoltRecord(tx.Bucket(boltRecordBucket), markIDBytes)
+		if err != nil {
+			return err
+		}
+		if !IsInactive(record, cutoff) {
+			return nil
+		}
+
+		deleted = true
+		return deleteBoltSync(tx, markIDBytes)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return deleted, nil
+}
+
+func (s *boltStore) Backup(w io.Writer) (*SnapshotInfo, error) {
+
+	// a read transaction sees a consistent view of the file, and doesn't block writers;
+	// counting the keys in the same transaction means the count matches what's written
+	var result SnapshotInfo
+	err := s.db.View(func(tx *bolt.Tx) error {
+		result.KeyCount = tx.Bucket(boltRecordBucket).Stats().KeyN
+
+		var err error
+		result.Size, err = tx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// CompactBolt rewrites the file without the free pages Bolt accumulates as records are
+// replaced; it needs the file to itself, so the server must not be running
+func CompactBolt(storageFile string, initTimeout time.Duration) error {
+
+	src, err := bolt.Open(storageFile, 0600, &bolt.Options{Timeout: initTimeout})
+	if err == bolt.ErrTimeout {
+		return fmt.Errorf("timed out waiting for [%s] to unlock; is something else using it?", storageFile)
+	}
+	if err != nil {
+		return err
+	}
+
+	compactFile := storageFile + ".compact"
+	os.Remove(compactFile)
+
+	dst, err := bolt.Open(compactFile, 0600, &bolt.Options{Timeout: initTimeout})
+	if err != nil {
+		src.Close()
+		return err
+	}
+
+	// copy across in chunks, so a large file doesn't need one enormous transaction
+	if err = bolt.Compact(dst, src, 64*1024*1024); err != nil {
+		dst.Close()
+		src.Close()
+		os.Remove(compactFile)
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		src.Close()
+		os.Remove(compactFile)
+		return err
+	}
+
+	// only swap the compacted copy in once it's safely written, and the original has let go
+	// of its lock; if it can't, the original stays where it is
+	if err = src.Close(); err != nil {
+		os.Remove(compactFile)
+		return err
+	}
+	return os.Rename(compactFile, storageFile)
+}
+
+func (s *boltStore) Setting(key string) (string, error) {
+
+	var result string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		result = string(tx.Bucket(boltSettingsBucket).Get([]byte(key)))
+		return nil
+	})
+	return result, err
+}
+
+func (s *boltStore) PutSetting(key, value string) error {
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSettingsBucket).Put([]byte(key), []byte(value))
+	})
+}
+
+func (s *boltStore) CreateInvite(invite *Invite) error {
+
+	inviteData, err := json.Marshal(invite)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bkInvites := tx.Bucket(boltInviteBucket)
+		if bkInvites.Get([]byte(invite.Code)) != nil {
+			return errInviteExists(invite.Code)
+		}
+		return bkInvites.Put([]byte(invite.Code), inviteData)
+	})
+}
+
+func (s *boltStore) Invites() ([]Invite, error) {
+
+	invites := []Invite{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltInviteBucket).ForEach(func(code, data []byte) error {
+			var invite Invite
+			if err := json.Unmarshal(data, &invite); err != nil {
+				return fmt.Errorf("invite [%s]: %s", code, err)
+			}
+			invites = append(invites, invite)
+			return nil
+		})
+	})
+	return invites, err
+}
+
+func (s *boltStore) UseInvite(code string) (*Invite, error) {
+
+	var invite Invite
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bkInvites := tx.Bucket(boltInviteBucket)
+
+		data := bkInvites.Get([]byte(code))
+		if data == nil {
+			return ErrInviteNotFound
+		}
+		if err := json.Unmarshal(data, &invite); err != nil {
+			return fmt.Errorf("invite [%s]: %s", code, err)
+		}
+		if err := invite.use(); err != nil {
+			return err
+		}
+
+		inviteData, err := json.Marshal(&invite)
+		if err != nil {
+			return err
+		}
+		return bkInvites.Put([]byte(code), inviteData)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+func (s *boltStore) ReleaseInvite(code string) error {
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bkInvites := tx.Bucket(boltInviteBucket)
+
+		data := bkInvites.Get([]byte(code))
+		if data == nil {
+			return ErrInviteNotFound
+		}
+		var invite Invite
+		if err := json.Unmarshal(data, &invite); err != nil {
+			return fmt.Errorf("invite [%s]: %s", code, err)
+		}
+		invite.release()
+
+		inviteData, err := json.Marshal(&invite)
+		if err != nil {
+			return err
+		}
+		return bkInvites.Put([]byte(code), inviteData)
+	})
+}
+
+func (s *boltStore) DeleteInvite(code string) error {
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bkInvites := tx.Bucket(boltInviteBucket)
+		if bkInvites.Get([]byte(code)) == nil {
+			return ErrInviteNotFound
+		}
+		return bkInvites.Delete([]byte(code))
+	})
+}
+
+func (s *boltStore) Backend() string {
+	return "bolt"
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
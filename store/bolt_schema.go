@@ -0,0 +1,391 @@
+package store
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * BoltDB files carry a schema version in a small bookkeeping bucket; on boot
+ * we check it and run any migrations needed to bring older files up to the
+ * layout this build expects, all within a single transaction so a failed
+ * migration leaves the file untouched
+ *
+ * files written before the schema version existed are treated as version 0,
+ * unless they already hold the records bucket, in which case the version is
+ * worked out from which of the later buckets are there
+ *
+ * v1 : the original layout, with each sync ID spread across three buckets
+ * v2 : a single bucket of JSON records, one per sync ID
+ * v3 : adds the history bucket, for keeping previous revisions
+ * v4 : adds the settings bucket, for server state that outlives a restart
+ * v5 : adds the invites bucket
+ *
+ */
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// bucket for our own bookkeeping, and the key within it holding the schema version
+var boltMetaBucket = []byte("XS")
+var boltSchemaKey = []byte("schema")
+
+// the v1 buckets, holding bookmark data, timestamp and client version respectively
+var boltV1DataBucket = []byte("BM")
+var boltV1TimestampBucket = []byte("TS")
+var boltV1VersionBucket = []byte("VR")
+
+// boltSchemaVersion is the layout this build reads and writes; when changing the
+// buckets, bump it and add the migration from the previous version to boltMigrations
+const boltSchemaVersion = 5
+
+// boltMigrations upgrade a file from the previous schema version to the one they're keyed by
+var boltMigrations = map[uint64]func(tx *bolt.Tx) error{
+	1: migrateBoltToV1,
+	2: migrateBoltToV2,
+	3: migrateBoltToV3,
+	4: migrateBoltToV4,
+	5: migrateBoltToV5,
+}
+
+// v1 is the original three-bucket layout; new files get the buckets created, older files
+// are checked to make sure they have all of them, as a partial set means something is amiss
+func migrateBoltToV1(tx *bolt.Tx) error {
+
+	buckets := [][]byte{boltV1DataBucket, boltV1TimestampBucket, boltV1VersionBucket}
+
+	found := 0
+	for _, bucket := range buckets {
+		if tx.Bucket(bucket) != nil {
+			found++
+		}
+	}
+	if found > 0 && found < len(buckets) {
+		return fmt.Errorf("found %d of the %d expected buckets", found, len(buckets))
+	}
+
+	for _, bucket := range buckets {
+		if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+	}
+	return nil
+}
+
+// v2 folds the three v1 buckets into one record per sync ID; any sync ID missing its timestamp
+// or version (which v1 could end up with, as the buckets were written separately) is kept, with
+// the gaps filled in, rather than being left unreadable
+func migrateBoltToV2(tx *bolt.Tx) error {
+
+	bkData := tx.Bucket(boltV1DataBucket)
+	bkTs := tx.Bucket(boltV1TimestampBucket)
+	bkVer := tx.Bucket(boltV1VersionBucket)
+
+	bkRecords, err := tx.CreateBucket(boltRecordBucket)
+	if err != nil {
+		return fmt.Errorf("create bucket: %s", err)
+	}
+
+	// carry the sequence over, as it's mixed into new sync IDs
+	if err = bkRecords.SetSequence(bkData.Sequence()); err != nil {
+		return err
+	}
+
+	migrationTime := createTimestampString()
+	migratedCount := 0
+
+	err = bkData.ForEach(func(id, data []byte) error {
+
+		record := SyncRecord{
+			Bookmarks:    string(data),
+			LastUpdated:  string(bkTs.Get(id)),
+			Version:      string(bkVer.Get(id)),
+			LastAccessed: migrationTime,
+		}
+
+		if len(record.LastUpdated) == 0 {
+			zLog.Warn("Sync ID missing timestamp during migration", zap.String("key", RedactSyncID(string(id))))
+			record.LastUpdated = migrationTime
+		}
+
+		// v1 never recorded when a sync was created, the last update is the best we have
+		record.Created = record.LastUpdated
+
+		migratedCount++
+		return putBoltRecord(bkRecords, id, &record)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, bucket := range [][]byte{boltV1DataBucket, boltV1TimestampBucket, boltV1VersionBucket} {
+		if err = tx.DeleteBucket(bucket); err != nil {
+			return fmt.Errorf("delete bucket: %s", err)
+		}
+	}
+
+	zLog.Info("Migrated sync IDs to single records", zap.Int("count", migratedCount))
+	return nil
+}
+
+// v3 only needs the (initially empty) history bucket
+func migrateBoltToV3(tx *bolt.Tx) error {
+
+	if _, err := tx.CreateBucket(boltHistoryBucket); err != nil {
+		return fmt.Errorf("create bucket: %s", err)
+	}
+	return nil
+}
+
+// v4 adds the settings bucket, again empty to begin with
+func migrateBoltToV4(tx *bolt.Tx) error {
+
+	if _, err := tx.CreateBucket(boltSettingsBucket); err != nil {
+		return fmt.Errorf("create bucket: %s", err)
+	}
+	return nil
+}
+
+// v5 adds the invites bucket, which also starts out empty
+func migrateBoltToV5(tx *bolt.Tx) error {
+
+	if _, err := tx.CreateBucket(boltInviteBucket); err != nil {
+		return fmt.Errorf("create bucket: %s", err)
+	}
+	return nil
+}
+
+// migrateBoltSchema brings the file up to boltSchemaVersion, then checks the result
+func migrateBoltSchema(db *bolt.DB) error {
+
+	return db.Update(func(tx *bolt.Tx) error {
+
+		fileVersion, err := getBoltSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+
+		bkMeta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+
+		// don't let an older build loose on a file it doesn't understand
+		if fileVersion > boltSchemaVersion {
+			return fmt.Errorf("file has schema version %d, this build only understands up to %d", fileVersion, boltSchemaVersion)
+		}
+
+		for fileVersion < boltSchemaVersion {
+
+			zLog.Info("Migrating BoltDB schema",
+				zap.Uint64("from", fileVersion),
+				zap.Uint64("to", fileVersion+1),
+			)
+
+			if err = boltMigrations[fileVersion+1](tx); err != nil {
+				return fmt.Errorf("migrating to schema version %d: %s", fileVersion+1, err)
+			}
+			fileVersion++
+
+			versionBytes := make([]byte, 8)
+			binary.BigEndian.PutUint64(versionBytes, fileVersion)
+			if err = bkMeta.Put(boltSchemaKey, versionBytes); err != nil {
+				return err
+			}
+		}
+
+		return verifyBoltSchema(tx)
+	})
+}
+
+// checkBoltSchema is the read-only counterpart to migrateBoltSchema, failing if the file isn't
+// already at the schema version this build expects
+func checkBoltSchema(db *bolt.DB) error {
+
+	return db.View(func(tx *bolt.Tx) error {
+
+		fileVersion, err := getBoltSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+
+		if fileVersion != boltSchemaVersion {
+			return fmt.Errorf("file has schema version %d, this build expects %d; it must be opened read-write (eg. by the server) to migrate it", fileVersion, boltSchemaVersion)
+		}
+
+		return verifyBoltSchema(tx)
+	})
+}
+
+// read the schema version from the meta bucket, or work it out for files from before we stored one
+func getBoltSchemaVersion(tx *bolt.Tx) (uint64, error) {
+
+	var stored []byte
+	if bkMeta := tx.Bucket(boltMetaBucket); bkMeta != nil {
+		stored = bkMeta.Get(boltSchemaKey)
+	}
+	if stored == nil {
+		return inferBoltSchemaVersion(tx), nil
+	}
+	if len(stored) != 8 {
+		return 0, fmt.Errorf("malformed schema version")
+	}
+	return binary.BigEndian.Uint64(stored), nil
+}
+
+// inferBoltSchemaVersion guesses the version of a file that doesn't say; without the records
+// bucket it's the original layout (or empty), otherwise each later bucket found adds one
+func inferBoltSchemaVersion(tx *bolt.Tx) uint64 {
+
+	if tx.Bucket(boltRecordBucket) == nil {
+		return 0
+	}
+
+	version := uint64(2)
+	for _, bucket := range [][]byte{boltHistoryBucket, boltSettingsBucket, boltInviteBucket} {
+		if tx.Bucket(bucket) == nil {
+			break
+		}
+		version++
+	}
+	return version
+}
+
+// verifyBoltSchema checks that everything the current schema version needs is present
+func verifyBoltSchema(tx *bolt.Tx) error {
+
+	for _, bucket := range [][]byte{boltRecordBucket, boltHistoryBucket, boltSettingsBucket, boltInviteBucket} {
+		if tx.Bucket(bucket) == nil {
+			return fmt.Errorf("missing bucket [%s]", bucket)
+		}
+	}
+	return nil
+}
+
+// the buckets a file at the given schema version must have
+func boltBucketsAtVersion(version uint64) [][]byte {
+	if version == 1 {
+		return [][]byte{boltV1DataBucket, boltV1TimestampBucket, boltV1VersionBucket}
+	}
+	return [][]byte{boltRecordBucket, boltHistoryBucket, boltSettingsBucket, boltInviteBucket}[:version-1]
+}
+
+// enough of the layout of a Bolt file's two meta pages to find how long the file should be; Bolt
+// writes them in the machine's byte order, which is little-endian on everything we run on
+const (
+	boltMagic              = 0xED0CDAED
+	boltPageHeaderSize     = 16
+	boltMetaChecksumOffset = 56
+	boltMetaSize           = 64
+)
+
+// checkBoltFileSize makes sure a file is at least as long as its meta pages say; Bolt maps the
+// file into memory and trusts them, so a truncated file crashes it rather than failing to open
+func checkBoltFileSize(snapshotFile string) error {
+
+	file, err := os.Open(snapshotFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// pull the page size, high water mark and transaction ID out of a meta page, if it's valid
+	readMeta := func(offset int64) (pageSize uint32, highWater, txid uint64, ok bool) {
+		page := make([]byte, boltPageHeaderSize+boltMetaSize)
+		if _, err := file.ReadAt(page, offset); err != nil {
+			return
+		}
+		meta := page[boltPageHeaderSize:]
+		if binary.LittleEndian.Uint32(meta[0:]) != boltMagic {
+			return
+		}
+		checksum := fnv.New64a()
+		checksum.Write(meta[:boltMetaChecksumOffset])
+		if checksum.Sum64() != binary.LittleEndian.Uint64(meta[boltMetaChecksumOffset:]) {
+			return
+		}
+		return binary.LittleEndian.Uint32(meta[8:]), binary.LittleEndian.Uint64(meta[40:]), binary.LittleEndian.Uint64(meta[48:]), true
+	}
+
+	// as Bolt does, the second meta page is found by the page size the first gives, if it's
+	// valid, and the newer of the two is the one that counts
+	pageSize, highWater, txid, ok := readMeta(0)
+	if !ok {
+		pageSize = uint32(os.Getpagesize())
+	}
+	pageSize1, highWater1, txid1, ok1 := readMeta(int64(pageSize))
+	switch {
+	case !ok && !ok1:
+		return errors.New("not a Bolt file")
+	case ok1 && (!ok || txid1 > txid):
+		pageSize, highWater = pageSize1, highWater1
+	}
+
+	if expected := int64(highWater) * int64(pageSize); info.Size() < expected {
+		return fmt.Errorf("file is truncated; it's %d bytes, and should be at least %d", info.Size(), expected)
+	}
+	return nil
+}
+
+// checkBoltSnapshot opens a file read-only and makes sure it's a Bolt file holding sync IDs at a
+// schema version we can migrate from, with every bucket that version should have
+func checkBoltSnapshot(snapshotFile string) error {
+
+	if err := checkBoltFileSize(snapshotFile); err != nil {
+		return err
+	}
+
+	db, err := bolt.Open(snapshotFile, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+
+		// go through the whole of the check, as it stops early only if we stop reading
+		var damaged error
+		for err := range tx.Check() {
+			if damaged == nil {
+				damaged = fmt.Errorf("file is damaged: %s", err)
+			}
+		}
+		if damaged != nil {
+			return damaged
+		}
+
+		fileVersion, err := getBoltSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+
+		// an unversioned file without the records bucket is either the original layout or
+		// nothing to do with us at all
+		if fileVersion == 0 {
+			if tx.Bucket(boltV1DataBucket) == nil {
+				return errors.New("no sync ID buckets found; not an xSyn file")
+			}
+			fileVersion = 1
+		}
+		if fileVersion > boltSchemaVersion {
+			return fmt.Errorf("file has schema version %d, this build only understands up to %d", fileVersion, boltSchemaVersion)
+		}
+
+		for _, bucket := range boltBucketsAtVersion(fileVersion) {
+			if tx.Bucket(bucket) == nil {
+				return fmt.Errorf("file has schema version %d but is missing bucket [%s]", fileVersion, bucket)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,243 @@
+package store
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * the Bolt store, including the migrations that bring files left by older
+ * builds up to date; those are seeded by hand, as the older builds wrote them
+ *
+ */
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func openTestBolt(t *testing.T, storageFile string, history HistoryPolicy) Store {
+	t.Helper()
+
+	s, err := OpenBolt(storageFile, time.Second, history, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestBoltConformance(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T, history HistoryPolicy) Store {
+		return openTestBolt(t, filepath.Join(t.TempDir(), "marks.db"), history)
+	})
+}
+
+// seedBolt writes a file by hand, as an older build would have left it
+func seedBolt(t *testing.T, storageFile string, seed func(tx *bolt.Tx) error) {
+	t.Helper()
+
+	db, err := bolt.Open(storageFile, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Update(seed); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// captureMigrations swaps in a logger that notes every schema migration, for the rest of the test
+func captureMigrations(t *testing.T) *observer.ObservedLogs {
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	previous := zLog
+	SetLogger(zap.New(core))
+	t.Cleanup(func() { SetLogger(previous) })
+
+	return logs
+}
+
+// check the file is at the current schema version, and that opening it again changes nothing
+func checkMigratedBolt(t *testing.T, storageFile string, logs *observer.ObservedLogs) {
+	t.Helper()
+
+	db, err := bolt.Open(storageFile, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		stored := tx.Bucket(boltMetaBucket).Get(boltSchemaKey)
+		if len(stored) != 8 || binary.BigEndian.Uint64(stored) != boltSchemaVersion {
+			t.Errorf("schema version is %x, want %d", stored, boltSchemaVersion)
+		}
+		for _, bucket := range [][]byte{boltV1DataBucket, boltV1TimestampBucket, boltV1VersionBucket} {
+			if tx.Bucket(bucket) != nil {
+				t.Errorf("v1 bucket [%s] left behind", bucket)
+			}
+		}
+		return verifyBoltSchema(tx)
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrations := logs.FilterMessage("Migrating BoltDB schema").Len()
+	if migrations == 0 {
+		t.Fatalf("no migrations were logged")
+	}
+
+	s, err := OpenBolt(storageFile, time.Second, HistoryPolicy{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if again := logs.FilterMessage("Migrating BoltDB schema").Len(); again != migrations {
+		t.Fatalf("opening again ran %d more migrations", again-migrations)
+	}
+
+	// and now it can be opened read-only, which refuses anything out of date
+	s, err = OpenBolt(storageFile, time.Second, HistoryPolicy{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+func TestBoltMigrateFromV1(t *testing.T) {
+	logs := captureMigrations(t)
+	storageFile := filepath.Join(t.TempDir(), "marks.db")
+
+	// the original layout, with no meta bucket; the second sync ID lost its timestamp somewhere
+	seedBolt(t, storageFile, func(tx *bolt.Tx) error {
+		data, _ := tx.CreateBucket(boltV1DataBucket)
+		timestamps, _ := tx.CreateBucket(boltV1TimestampBucket)
+		versions, _ := tx.CreateBucket(boltV1VersionBucket)
+
+		data.SetSequence(41)
+		data.Put([]byte("0123456789abcdef0123456789abcdef"), []byte("first bookmarks"))
+		timestamps.Put([]byte("0123456789abcdef0123456789abcdef"), []byte("2019-01-02T03:04:05.678Z"))
+		versions.Put([]byte("0123456789abcdef0123456789abcdef"), []byte("1.4.0"))
+		data.Put([]byte("fedcba9876543210fedcba9876543210"), []byte("second bookmarks"))
+		return versions.Put([]byte("fedcba9876543210fedcba9876543210"), []byte("1.5.0"))
+	})
+
+	s := openTestBolt(t, storageFile, HistoryPolicy{})
+
+	record, err := s.Peek("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Bookmarks != "first bookmarks" || record.Version != "1.4.0" || record.Size != 15 ||
+		record.LastUpdated != "2019-01-02T03:04:05.678Z" || record.Created != record.LastUpdated {
+		t.Fatalf("unexpected migrated record %+v", record)
+	}
+
+	record, err = s.Peek("fedcba9876543210fedcba9876543210")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Bookmarks != "second bookmarks" || record.Version != "1.5.0" || len(record.LastUpdated) == 0 {
+		t.Fatalf("unexpected migrated record %+v", record)
+	}
+
+	// the sequence is mixed into new sync IDs, so it has to carry on from where it was
+	err = s.(*boltStore).db.View(func(tx *bolt.Tx) error {
+		if sequence := tx.Bucket(boltRecordBucket).Sequence(); sequence != 41 {
+			t.Errorf("sequence is %d, want 41", sequence)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	checkMigratedBolt(t, storageFile, logs)
+}
+
+func TestBoltMigrationRedactsSyncIDs(t *testing.T) {
+	logs := captureMigrations(t)
+	storageFile := filepath.Join(t.TempDir(), "marks.db")
+	const markID = "fedcba9876543210fedcba9876543210"
+
+	// a v1 file where the one sync ID has no timestamp, which the migration warns about
+	seedBolt(t, storageFile, func(tx *bolt.Tx) error {
+		data, _ := tx.CreateBucket(boltV1DataBucket)
+		tx.CreateBucket(boltV1TimestampBucket)
+		tx.CreateBucket(boltV1VersionBucket)
+		return data.Put([]byte(markID), []byte("bookmarks"))
+	})
+	openTestBolt(t, storageFile, HistoryPolicy{}).Close()
+
+	if logs.FilterMessage("Sync ID missing timestamp during migration").Len() != 1 {
+		t.Fatalf("missing timestamp wasn't logged")
+	}
+	for _, entry := range logs.All() {
+		logged := fmt.Sprint(entry.Message, entry.ContextMap())
+		if strings.Contains(logged, markID) {
+			t.Errorf("full sync ID logged in %q", logged)
+		}
+	}
+}
+
+func TestBoltMigrateUnversionedRecords(t *testing.T) {
+	logs := captureMigrations(t)
+	storageFile := filepath.Join(t.TempDir(), "marks.db")
+
+	// a records bucket but no meta bucket to say what version it is
+	seedBolt(t, storageFile, func(tx *bolt.Tx) error {
+		records, err := tx.CreateBucket(boltRecordBucket)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(boltRecord{Schema: boltRecordSchema, SyncRecord: SyncRecord{
+			Bookmarks:    "kept",
+			LastUpdated:  "2020-01-02T03:04:05.678Z",
+			Version:      "1.5.2",
+			Created:      "2020-01-01T00:00:00.000Z",
+			LastAccessed: "2020-01-03T00:00:00.000Z",
+		}})
+		return records.Put([]byte("0123456789abcdef0123456789abcdef"), data)
+	})
+
+	s := openTestBolt(t, storageFile, HistoryPolicy{})
+	record, err := s.Peek("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Bookmarks != "kept" || record.Created != "2020-01-01T00:00:00.000Z" || record.LastAccessed != "2020-01-03T00:00:00.000Z" {
+		t.Fatalf("unexpected record %+v", record)
+	}
+	s.Close()
+
+	checkMigratedBolt(t, storageFile, logs)
+}
+
+func TestBoltNewerSchema(t *testing.T) {
+	storageFile := filepath.Join(t.TempDir(), "marks.db")
+
+	seedBolt(t, storageFile, func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucket(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		version := make([]byte, 8)
+		binary.BigEndian.PutUint64(version, boltSchemaVersion+1)
+		return meta.Put(boltSchemaKey, version)
+	})
+
+	if s, err := OpenBolt(storageFile, time.Second, HistoryPolicy{}, false); err == nil {
+		s.Close()
+		t.Fatalf("opened a file from a newer build")
+	}
+}
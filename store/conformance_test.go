@@ -0,0 +1,473 @@
+package store
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * the behaviour every Store has to share, whatever it keeps its data in;
+ * each backend's own tests run this against a fresh store of their kind
+ *
+ */
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// opens an empty store of some kind, closed again when the test finishes
+type openTestStore func(t *testing.T, history HistoryPolicy) Store
+
+// the history policy the conformance tests run with, unless they need something else
+var conformanceHistory = HistoryPolicy{Revisions: 3}
+
+func testStoreConformance(t *testing.T, open openTestStore) {
+	t.Run("CreateSync", func(t *testing.T) { testCreateSync(t, open(t, conformanceHistory)) })
+	t.Run("Put", func(t *testing.T) { testPut(t, open(t, conformanceHistory)) })
+	t.Run("LastAccessed", func(t *testing.T) { testLastAccessed(t, open(t, conformanceHistory)) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, open(t, conformanceHistory)) })
+	t.Run("DeleteIfInactive", func(t *testing.T) { testDeleteIfInactive(t, open(t, conformanceHistory)) })
+	t.Run("Each", func(t *testing.T) { testEach(t, open(t, conformanceHistory)) })
+	t.Run("Stats", func(t *testing.T) { testStats(t, open(t, conformanceHistory)) })
+	t.Run("History", func(t *testing.T) { testHistory(t, open(t, conformanceHistory)) })
+	t.Run("HistoryMaxAge", func(t *testing.T) {
+		testHistoryMaxAge(t, open(t, HistoryPolicy{Revisions: 3, MaxAge: time.Hour}))
+	})
+	t.Run("NoHistory", func(t *testing.T) { testNoHistory(t, open(t, HistoryPolicy{})) })
+	t.Run("RollBack", func(t *testing.T) { testRollBack(t, open(t, conformanceHistory)) })
+	t.Run("Settings", func(t *testing.T) { testSettings(t, open(t, conformanceHistory)) })
+	t.Run("Invites", func(t *testing.T) { testInvites(t, open(t, conformanceHistory)) })
+}
+
+// create a sync ID, failing the test if that doesn't work
+func mustCreateSync(t *testing.T, s Store) (string, string) {
+	t.Helper()
+
+	id, lastUpdated, err := s.CreateSync("1.5.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, lastUpdated
+}
+
+// write new bookmarks to a sync ID, failing the test if that doesn't work
+func mustPut(t *testing.T, s Store, id, bookmarks string) string {
+	t.Helper()
+
+	lastUpdated, err := s.Put(id, bookmarks, "")
+	if err != nil {
+		t.Fatalf("put %s: %s", bookmarks, err)
+	}
+	return lastUpdated
+}
+
+func testCreateSync(t *testing.T, s Store) {
+
+	id, lastUpdated := mustCreateSync(t, s)
+	if !IsValidSyncID(id) {
+		t.Fatalf("created sync ID [%s] isn't valid", id)
+	}
+
+	record, err := s.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Bookmarks != "" || record.Size != 0 || record.Version != "1.5.2" ||
+		record.LastUpdated != lastUpdated || record.Created != lastUpdated || record.LastAccessed != lastUpdated {
+		t.Fatalf("unexpected new record %+v", record)
+	}
+
+	// reading again so soon isn't worth rewriting the record for
+	time.Sleep(2 * time.Millisecond)
+	if record, err = s.Get(id); err != nil || record.LastAccessed != lastUpdated {
+		t.Fatalf("a second read moved lastAccessed; %+v, %v", record, err)
+	}
+
+	if other, _ := mustCreateSync(t, s); other == id {
+		t.Fatalf("created the same sync ID twice")
+	}
+
+	if _, err = s.Get(strings.Repeat("0", 32)); err != ErrSyncNotFound {
+		t.Fatalf("get unknown sync ID: %v", err)
+	}
+}
+
+func testPut(t *testing.T, s Store) {
+
+	id, created := mustCreateSync(t, s)
+
+	// lastUpdated has to move forward with every write, however quickly they come
+	previous := created
+	for _, bookmarks := range []string{"one", "two", "three"} {
+		lastUpdated, err := s.Put(id, bookmarks, previous)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !timestampBefore(previous, lastUpdated) {
+			t.Fatalf("lastUpdated went from %s to %s", previous, lastUpdated)
+		}
+		previous = lastUpdated
+	}
+
+	record, err := s.Peek(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Bookmarks != "three" || record.Size != 5 || record.LastUpdated != previous || record.Created != created {
+		t.Fatalf("unexpected record %+v", record)
+	}
+
+	if _, err = s.Put(id, "stale", created); err != ErrSyncConflict {
+		t.Fatalf("put with a stale lastUpdated: %v", err)
+	}
+	if lastUpdated, err := s.LastUpdated(id); err != nil || lastUpdated != previous {
+		t.Fatalf("a conflicting put changed lastUpdated to %s, %v", lastUpdated, err)
+	}
+	if _, err = s.Put(strings.Repeat("0", 32), "nowhere", ""); err != ErrSyncNotFound {
+		t.Fatalf("put to an unknown sync ID: %v", err)
+	}
+}
+
+func testLastAccessed(t *testing.T, s Store) {
+
+	const id = "0123456789abcdef0123456789abcdef"
+	const longAgo = "2020-01-02T03:04:05.678Z"
+
+	err := s.PutRecord(id, &SyncRecord{Bookmarks: "old", LastUpdated: longAgo, Created: longAgo, LastAccessed: longAgo})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// looking doesn't count, reading does
+	if record, err := s.Peek(id); err != nil || record.LastAccessed != longAgo {
+		t.Fatalf("peek moved lastAccessed; %+v, %v", record, err)
+	}
+	if _, err = s.Get(id); err != nil {
+		t.Fatal(err)
+	}
+	record, err := s.Peek(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !timestampBefore(longAgo, record.LastAccessed) || record.LastUpdated != longAgo {
+		t.Fatalf("read didn't note the access; %+v", record)
+	}
+}
+
+func testDelete(t *testing.T, s Store) {
+
+	id, _ := mustCreateSync(t, s)
+	kept, _ := mustCreateSync(t, s)
+	mustPut(t, s, id, "one")
+	mustPut(t, s, id, "two")
+
+	if err := s.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(id); err != ErrSyncNotFound {
+		t.Fatalf("get after delete: %v", err)
+	}
+	if _, err := s.History(id); err != ErrSyncNotFound {
+		t.Fatalf("history after delete: %v", err)
+	}
+	if err := s.Delete(id); err != ErrSyncNotFound {
+		t.Fatalf("delete twice: %v", err)
+	}
+	if _, err := s.Get(kept); err != nil {
+		t.Fatalf("delete took another sync ID with it: %v", err)
+	}
+}
+
+func testDeleteIfInactive(t *testing.T, s Store) {
+
+	id, _ := mustCreateSync(t, s)
+	mustPut(t, s, id, "one")
+	mustPut(t, s, id, "two")
+
+	// just created, so it's active by any cutoff up to now
+	if deleted, err := s.DeleteIfInactive(id, time.Now().Add(-time.Hour)); err != nil || deleted {
+		t.Fatalf("deleted an active sync ID: %v, %v", deleted, err)
+	}
+	if _, err := s.Peek(id); err != nil {
+		t.Fatal(err)
+	}
+
+	// a cutoff in the future makes everything inactive
+	if deleted, err := s.DeleteIfInactive(id, time.Now().Add(time.Hour)); err != nil || !deleted {
+		t.Fatalf("didn't delete an inactive sync ID: %v, %v", deleted, err)
+	}
+	if _, err := s.Peek(id); err != ErrSyncNotFound {
+		t.Fatalf("peek after delete: %v", err)
+	}
+	if _, err := s.History(id); err != ErrSyncNotFound {
+		t.Fatalf("history after delete: %v", err)
+	}
+	if _, err := s.DeleteIfInactive(id, time.Now().Add(time.Hour)); err != ErrSyncNotFound {
+		t.Fatalf("delete twice: %v", err)
+	}
+}
+
+func testEach(t *testing.T, s Store) {
+
+	created := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		id, _ := mustCreateSync(t, s)
+		mustPut(t, s, id, id)
+		created[id] = true
+	}
+
+	previous := ""
+	err := s.Each(func(id string, record *SyncRecord) error {
+		if !created[id] {
+			t.Errorf("unexpected sync ID [%s]", id)
+		}
+		if id <= previous {
+			t.Errorf("sync IDs out of order; [%s] after [%s]", id, previous)
+		}
+		if record.Bookmarks != id {
+			t.Errorf("sync ID [%s] came with the wrong bookmarks", id)
+		}
+		delete(created, id)
+		previous = id
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) > 0 {
+		t.Fatalf("missed %d sync IDs", len(created))
+	}
+}
+
+func testStats(t *testing.T, s Store) {
+
+	for i := 0; i < 3; i++ {
+		id, _ := mustCreateSync(t, s)
+		mustPut(t, s, id, strings.Repeat("x", 100))
+	}
+
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.KeyCount != 3 || stats.SizeBytes < 300 {
+		t.Fatalf("unexpected stats %d keys, %d bytes", stats.KeyCount, stats.SizeBytes)
+	}
+}
+
+func testHistory(t *testing.T, s Store) {
+
+	id, _ := mustCreateSync(t, s)
+
+	// nothing is kept from before the first write, and only the last three after that
+	var written []string
+	for _, bookmarks := range []string{"one", "two", "three", "four", "five"} {
+		written = append(written, mustPut(t, s, id, bookmarks))
+	}
+
+	revisions, err := s.History(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 3 {
+		t.Fatalf("%d revisions, want 3", len(revisions))
+	}
+	for i, revision := range revisions {
+		if revision.Bookmarks != "" {
+			t.Fatalf("history includes bookmarks data")
+		}
+		// newest first; the newest revision is what "five" replaced
+		if revision.LastUpdated != written[3-i] || revision.Replaced != written[4-i] {
+			t.Fatalf("revision %d is %+v", i, revision)
+		}
+		if i > 0 && revision.Revision >= revisions[i-1].Revision {
+			t.Fatalf("revisions out of order")
+		}
+	}
+
+	revision, err := s.Revision(id, revisions[0].Revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision.Bookmarks != "four" || revision.Size != 4 {
+		t.Fatalf("unexpected revision %+v", revision)
+	}
+
+	if _, err = s.Revision(id, revisions[0].Revision+100); err != ErrRevisionNotFound {
+		t.Fatalf("unknown revision: %v", err)
+	}
+	if _, err = s.Revision(strings.Repeat("0", 32), 1); err != ErrSyncNotFound {
+		t.Fatalf("revision of an unknown sync ID: %v", err)
+	}
+}
+
+func testHistoryMaxAge(t *testing.T, s Store) {
+
+	id, _ := mustCreateSync(t, s)
+	mustPut(t, s, id, "one")
+	mustPut(t, s, id, "two")
+	mustPut(t, s, id, "three")
+
+	revisions, err := s.History(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("%d revisions, want 2", len(revisions))
+	}
+
+	// nothing is written from here on, so nothing gets trimmed; the revisions have to
+	// disappear as soon as they're too old all the same
+	t.Cleanup(func() { timeNow = time.Now })
+	timeNow = func() time.Time { return time.Now().Add(2 * time.Hour) }
+
+	if revisions, err := s.History(id); err != nil || len(revisions) != 0 {
+		t.Fatalf("history past max age: %v, %v", revisions, err)
+	}
+	if _, err = s.Revision(id, revisions[0].Revision); err != ErrRevisionNotFound {
+		t.Fatalf("revision past max age: %v", err)
+	}
+	if _, err = s.RollBack(id, revisions[0].Revision); err != ErrRevisionNotFound {
+		t.Fatalf("rollback past max age: %v", err)
+	}
+
+	record, err := s.Peek(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Bookmarks != "three" {
+		t.Fatalf("bookmarks are %q after a failed rollback", record.Bookmarks)
+	}
+}
+
+func testNoHistory(t *testing.T, s Store) {
+
+	id, _ := mustCreateSync(t, s)
+	mustPut(t, s, id, "one")
+	mustPut(t, s, id, "two")
+
+	revisions, err := s.History(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 0 {
+		t.Fatalf("%d revisions kept with history turned off", len(revisions))
+	}
+}
+
+func testRollBack(t *testing.T, s Store) {
+
+	id, _ := mustCreateSync(t, s)
+	mustPut(t, s, id, "good")
+	before := mustPut(t, s, id, "broken")
+
+	revisions, err := s.History(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastUpdated, err := s.RollBack(id, revisions[0].Revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !timestampBefore(before, lastUpdated) {
+		t.Fatalf("rollback didn't move lastUpdated on from %s", before)
+	}
+
+	record, err := s.Peek(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Bookmarks != "good" || record.LastUpdated != lastUpdated {
+		t.Fatalf("unexpected record after rollback %+v", record)
+	}
+
+	// what was rolled back over goes into the history, so the rollback can be undone
+	revisions, err = s.History(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	undo, err := s.Revision(id, revisions[0].Revision)
+	if err != nil || undo.Bookmarks != "broken" {
+		t.Fatalf("rolled back bookmarks not in history: %+v, %v", undo, err)
+	}
+
+	if _, err = s.RollBack(id, 1000); err != ErrRevisionNotFound {
+		t.Fatalf("roll back to unknown revision: %v", err)
+	}
+}
+
+func testSettings(t *testing.T, s Store) {
+
+	if value, err := s.Setting("missing"); err != nil || value != "" {
+		t.Fatalf("unset setting is %q, %v", value, err)
+	}
+
+	for _, value := range []string{"first", "second", ""} {
+		if err := s.PutSetting("key", value); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.Setting("key"); err != nil || got != value {
+			t.Fatalf("setting is %q, %v; want %q", got, err, value)
+		}
+	}
+}
+
+func testInvites(t *testing.T, s Store) {
+
+	invite, err := NewInvite(1, 0, "testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.CreateInvite(invite); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.CreateInvite(invite); err == nil {
+		t.Fatalf("created the same invite code twice")
+	}
+
+	used, err := s.UseInvite(invite.Code)
+	if err != nil || used.Uses != 1 || len(used.LastUsed) == 0 {
+		t.Fatalf("use invite: %+v, %v", used, err)
+	}
+	if _, err = s.UseInvite(invite.Code); err != ErrInviteUsedUp {
+		t.Fatalf("use invite twice: %v", err)
+	}
+
+	// a use handed back can be taken again
+	if err = s.ReleaseInvite(invite.Code); err != nil {
+		t.Fatal(err)
+	}
+	if used, err = s.UseInvite(invite.Code); err != nil || used.Uses != 1 {
+		t.Fatalf("use released invite: %+v, %v", used, err)
+	}
+
+	invites, err := s.Invites()
+	if err != nil || len(invites) != 1 || invites[0].Uses != 1 || invites[0].Note != "testing" {
+		t.Fatalf("invites %+v, %v", invites, err)
+	}
+
+	if err = s.DeleteInvite(invite.Code); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.DeleteInvite(invite.Code); err != ErrInviteNotFound {
+		t.Fatalf("delete invite twice: %v", err)
+	}
+	if _, err = s.UseInvite(invite.Code); err != ErrInviteNotFound {
+		t.Fatalf("use deleted invite: %v", err)
+	}
+	if err = s.ReleaseInvite(invite.Code); err != ErrInviteNotFound {
+		t.Fatalf("release deleted invite: %v", err)
+	}
+}
+
+// timestampBefore compares two of our timestamps as times; anything unparseable fails
+func timestampBefore(a, b string) bool {
+	aTime, errA := time.Parse(time.RFC3339Nano, a)
+	bTime, errB := time.Parse(time.RFC3339Nano, b)
+	return errA == nil && errB == nil && aTime.Before(bTime)
+}
+
+func TestMemoryConformance(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T, history HistoryPolicy) Store {
+		return NewMemory(history)
+	})
+}
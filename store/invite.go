@@ -0,0 +1,149 @@
+package store
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * invite codes, for servers that only let invited people create sync IDs;
+ * each code can be limited to a number of uses and given an expiry time, and
+ * counts how often it's been used, so an admin can see who took them up
+ *
+ * codes are short enough to read out or type in, drawn from an alphabet
+ * without the letters and digits that are easily mistaken for each other,
+ * and matched without regard to case or the dashes between the groups
+ *
+ */
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// returned by a Store when an invite code can't be used to create a sync ID
+var ErrInviteNotFound = errors.New("invite code not found")
+var ErrInviteExpired = errors.New("invite code has expired")
+var ErrInviteUsedUp = errors.New("invite code has been used up")
+
+// Invite is a single invite code; a MaxUses of 0 allows any number of uses, and an empty Expires
+// never expires. the timestamps are in the same format as lastUpdated
+type Invite struct {
+	Code     string `json:"code"`
+	Note     string `json:"note,omitempty"`
+	Created  string `json:"created"`
+	Expires  string `json:"expires,omitempty"`
+	MaxUses  int    `json:"maxUses"`
+	Uses     int    `json:"uses"`
+	LastUsed string `json:"lastUsed,omitempty"`
+}
+
+// NewInvite fills in an invite ready for Store.CreateInvite, with a fresh code; validFor of 0 means
+// it never expires
+func NewInvite(maxUses int, validFor time.Duration, note string) (*Invite, error) {
+
+	code, err := generateInviteCode()
+	if err != nil {
+		return nil, err
+	}
+
+	invite := &Invite{
+		Code:    code,
+		Note:    note,
+		Created: createTimestampString(),
+		MaxUses: maxUses,
+	}
+	if validFor > 0 {
+		invite.Expires = time.Now().UTC().Add(validFor).Format(TimestampFormat)
+	}
+	return invite, nil
+}
+
+// Usable checks whether the invite can be used (again) at the given time, returning
+// ErrInviteExpired or ErrInviteUsedUp if not
+func (i *Invite) Usable(now time.Time) error {
+
+	if len(i.Expires) > 0 {
+		expiresTime, err := time.Parse(time.RFC3339Nano, i.Expires)
+		if err != nil || !now.Before(expiresTime) {
+			return ErrInviteExpired
+		}
+	}
+	if i.MaxUses > 0 && i.Uses >= i.MaxUses {
+		return ErrInviteUsedUp
+	}
+	return nil
+}
+
+// count one use of the invite, checking first that it's allowed
+func (i *Invite) use() error {
+
+	if err := i.Usable(time.Now()); err != nil {
+		return err
+	}
+	i.Uses++
+	i.LastUsed = createTimestampString()
+	return nil
+}
+
+// hand back a use, as if it had never been taken
+func (i *Invite) release() {
+	if i.Uses > 0 {
+		i.Uses--
+	}
+}
+
+// no 0/O, 1/I/L or 2/Z to trip over
+const inviteCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXY3456789"
+
+// an invite code is this many groups of this many characters, eg. "K7PX-3MRA-WQ9D"
+const inviteCodeGroups = 3
+const inviteCodeGroupLength = 4
+
+// generateInviteCode makes a new random invite code; with 29^12 of them to choose from,
+// a collision is unlikely enough that the store just refuses to overwrite an existing one
+func generateInviteCode() (string, error) {
+
+	alphabetSize := big.NewInt(int64(len(inviteCodeAlphabet)))
+
+	var code strings.Builder
+	for i := 0; i < inviteCodeGroups*inviteCodeGroupLength; i++ {
+		if i > 0 && i%inviteCodeGroupLength == 0 {
+			code.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, alphabetSize)
+		if err != nil {
+			return "", err
+		}
+		code.WriteByte(inviteCodeAlphabet[n.Int64()])
+	}
+	return code.String(), nil
+}
+
+// NormalizeInviteCode puts an invite code as typed by a person into the form it's stored in;
+// upper case, with the dashes put back where they belong
+func NormalizeInviteCode(code string) string {
+
+	var stripped strings.Builder
+	for _, r := range strings.ToUpper(code) {
+		if r != '-' && r != ' ' {
+			stripped.WriteRune(r)
+		}
+	}
+
+	plain := stripped.String()
+	if len(plain) != inviteCodeGroups*inviteCodeGroupLength {
+		return plain
+	}
+
+	groups := make([]string, 0, inviteCodeGroups)
+	for i := 0; i < len(plain); i += inviteCodeGroupLength {
+		groups = append(groups, plain[i:i+inviteCodeGroupLength])
+	}
+	return strings.Join(groups, "-")
+}
+
+// errInviteExists is returned by CreateInvite if the code is already taken
+func errInviteExists(code string) error {
+	return fmt.Errorf("invite code [%s] already exists", code)
+}
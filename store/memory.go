@@ -0,0 +1,376 @@
+package store
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * in-memory implementation of the Store, with nothing persisted; useful for
+ * exercising the route handlers in tests or for throwaway instances
+ *
+ */
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryStore struct {
+	lock    sync.RWMutex
+	records map[string]SyncRecord
+	seqID   uint64
+
+	// previous revisions per sync ID, newest first, along with the last revision number used
+	history       HistoryPolicy
+	revisions     map[string][]SyncRevision
+	lastRevisions map[string]uint64
+
+	settings map[string]string
+	invites  map[string]Invite
+}
+
+// NewMemory creates an empty in-memory store
+func NewMemory(history HistoryPolicy) Store {
+	return &memoryStore{
+		records:       make(map[string]SyncRecord),
+		history:       history,
+		revisions:     make(map[string][]SyncRevision),
+		lastRevisions: make(map[string]uint64),
+		settings:      make(map[string]string),
+		invites:       make(map[string]Invite),
+	}
+}
+
+func (s *memoryStore) CreateSync(clientVersion string) (string, string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.seqID++
+	newID, err := generateSyncID(s.seqID, func(id []byte) bool {
+		_, exists := s.records[string(id)]
+		return exists
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	imprintTime := createTimestampString()
+	s.records[newID] = SyncRecord{
+		LastUpdated:  imprintTime,
+		Version:      clientVersion,
+		Created:      imprintTime,
+		LastAccessed: imprintTime,
+	}
+
+	return newID, imprintTime, nil
+}
+
+func (s *memoryStore) Get(id string) (*SyncRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	record, exists := s.records[id]
+	if !exists {
+		return nil, ErrSyncNotFound
+	}
+
+	// as with the other stores, only note the access once it's worth noting
+	if needsTouch(record.LastAccessed) {
+		record.LastAccessed = createTimestampString()
+		s.records[id] = record
+	}
+
+	return &record, nil
+}
+
+func (s *memoryStore) Peek(id string) (*SyncRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	record, exists := s.records[id]
+	if !exists {
+		return nil, ErrSyncNotFound
+	}
+	return &record, nil
+}
+
+func (s *memoryStore) Put(id, bookmarks, expectedLastUpdated string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	record, exists := s.records[id]
+	if !exists {
+		return "", ErrSyncNotFound
+	}
+	if len(expectedLastUpdated) > 0 && !TimestampsMatch(record.LastUpdated, expectedLastUpdated) {
+		return "", ErrSyncConflict
+	}
+
+	imprintTime := nextTimestampString(record.LastUpdated)
+	s.replaceBookmarks(id, record, bookmarks, imprintTime)
+
+	return imprintTime, nil
+}
+
+// replaceBookmarks moves the record's current bookmarks into its history, trimmed to
+// the history policy, and then stores the record with the new bookmarks and timestamp;
+// the caller must hold the write lock
+func (s *memoryStore) replaceBookmarks(id string, record SyncRecord, bookmarks, imprintTime string) {
+
+	// a freshly created sync ID has nothing worth keeping
+	if s.history.Revisions > 0 && len(record.Bookmarks) > 0 {
+		s.lastRevisions[id]++
+		s.revisions[id] = append([]SyncRevision{{
+			Revision:    s.lastRevisions[id],
+			Bookmarks:   record.Bookmarks,
+			LastUpdated: record.LastUpdated,
+			Replaced:    imprintTime,
+			Size:        record.Size,
+		}}, s.revisions[id]...)
+	}
+	s.revisions[id] = s.revisions[id][:s.history.retained(s.revisions[id])]
+
+	record.Bookmarks = bookmarks
+	record.Size = len(bookmarks)
+	record.LastUpdated = imprintTime
+	s.records[id] = record
+}
+
+func (s *memoryStore) PutRecord(id string, record *SyncRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	written := *record
+	written.Size = len(written.Bookmarks)
+
+	if existing, exists := s.records[id]; exists {
+		s.replaceBookmarks(id, existing, written.Bookmarks, createTimestampString())
+	}
+	s.records[id] = written
+
+	return nil
+}
+
+func (s *memoryStore) LastUpdated(id string) (string, error) {
+	record, err := s.Get(id)
+	if err != nil {
+		return "", err
+	}
+	return record.LastUpdated, nil
+}
+
+func (s *memoryStore) Version(id string) (string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	record, exists := s.records[id]
+	if !exists {
+		return "", ErrSyncNotFound
+	}
+	return record.Version, nil
+}
+
+func (s *memoryStore) Stats() (*Stats, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	result := Stats{KeyCount: len(s.records)}
+	for _, record := range s.records {
+		result.SizeBytes += int64(record.Size)
+	}
+	return &result, nil
+}
+
+func (s *memoryStore) Each(fn func(id string, record *SyncRecord) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	// walk in ID order, to match the other stores
+	ids := make([]string, 0, len(s.records))
+	for id := range s.records {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		record := s.records[id]
+		if err := fn(id, &record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) History(id string) ([]SyncRevision, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if _, exists := s.records[id]; !exists {
+		return nil, ErrSyncNotFound
+	}
+
+	retained := s.revisions[id][:s.history.retained(s.revisions[id])]
+
+	revisions := make([]SyncRevision, 0, len(retained))
+	for _, revision := range retained {
+		revision.Bookmarks = ""
+		revisions = append(revisions, revision)
+	}
+	return revisions, nil
+}
+
+// find a single revision that hasn't expired; the caller must hold the lock
+func (s *memoryStore) findRevision(id string, revision uint64) (*SyncRevision, error) {
+
+	if _, exists := s.records[id]; !exists {
+		return nil, ErrSyncNotFound
+	}
+	for _, candidate := range s.revisions[id] {
+		if candidate.Revision == revision && !s.history.expired(&candidate) {
+			return &candidate, nil
+		}
+	}
+	return nil, ErrRevisionNotFound
+}
+
+func (s *memoryStore) Revision(id string, revision uint64) (*SyncRevision, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.findRevision(id, revision)
+}
+
+func (s *memoryStore) RollBack(id string, revision uint64) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	previous, err := s.findRevision(id, revision)
+	if err != nil {
+		return "", err
+	}
+
+	record := s.records[id]
+	imprintTime := nextTimestampString(record.LastUpdated)
+	s.replaceBookmarks(id, record, previous.Bookmarks, imprintTime)
+
+	return imprintTime, nil
+}
+
+func (s *memoryStore) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.records[id]; !exists {
+		return ErrSyncNotFound
+	}
+	delete(s.records, id)
+	delete(s.revisions, id)
+	delete(s.lastRevisions, id)
+	return nil
+}
+
+func (s *memoryStore) DeleteIfInactive(id string, cutoff time.Time) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	record, exists := s.records[id]
+	if !exists {
+		return false, ErrSyncNotFound
+	}
+	if !IsInactive(&record, cutoff) {
+		return false, nil
+	}
+	delete(s.records, id)
+	delete(s.revisions, id)
+	delete(s.lastRevisions, id)
+	return true, nil
+}
+
+// there's no file format to snapshot into
+func (s *memoryStore) Backup(w io.Writer) (*SnapshotInfo, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *memoryStore) Setting(key string) (string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.settings[key], nil
+}
+
+func (s *memoryStore) PutSetting(key, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.settings[key] = value
+	return nil
+}
+
+func (s *memoryStore) CreateInvite(invite *Invite) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.invites[invite.Code]; exists {
+		return errInviteExists(invite.Code)
+	}
+	s.invites[invite.Code] = *invite
+	return nil
+}
+
+func (s *memoryStore) Invites() ([]Invite, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	invites := make([]Invite, 0, len(s.invites))
+	for _, invite := range s.invites {
+		invites = append(invites, invite)
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].Code < invites[j].Code })
+	return invites, nil
+}
+
+func (s *memoryStore) UseInvite(code string) (*Invite, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	invite, exists := s.invites[code]
+	if !exists {
+		return nil, ErrInviteNotFound
+	}
+	if err := invite.use(); err != nil {
+		return nil, err
+	}
+	s.invites[code] = invite
+	return &invite, nil
+}
+
+func (s *memoryStore) ReleaseInvite(code string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	invite, exists := s.invites[code]
+	if !exists {
+		return ErrInviteNotFound
+	}
+	invite.release()
+	s.invites[code] = invite
+	return nil
+}
+
+func (s *memoryStore) DeleteInvite(code string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.invites[code]; !exists {
+		return ErrInviteNotFound
+	}
+	delete(s.invites, code)
+	return nil
+}
+
+func (s *memoryStore) Backend() string {
+	return "memory"
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,831 @@
+package store
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * SQLite implementation of the Store, using the pure-Go modernc driver so we
+ * still build without cgo; everything lives in a single 'syncs' table that can
+ * be inspected with the standard sqlite3 tooling. the database runs in WAL mode
+ * so that other processes (backup scripts, curious admins) can read while we write
+ *
+ * the schema version is kept in sqlite's own user_version pragma, and upgraded
+ * on open in the same way as the Bolt file
+ *
+ */
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fatih/structs"
+	"go.uber.org/zap"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations upgrade the database one schema version at a time; entry N takes
+// a database from user_version N to N+1, so new steps only ever go on the end
+var sqliteMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS syncs (
+		id           TEXT PRIMARY KEY NOT NULL,
+		bookmarks    TEXT NOT NULL DEFAULT '',
+		last_updated TEXT NOT NULL,
+		version      TEXT NOT NULL DEFAULT ''
+	);`,
+	`ALTER TABLE syncs ADD COLUMN created TEXT NOT NULL DEFAULT '';
+	ALTER TABLE syncs ADD COLUMN last_accessed TEXT NOT NULL DEFAULT '';
+	ALTER TABLE syncs ADD COLUMN size INTEGER NOT NULL DEFAULT 0;
+	UPDATE syncs SET created = last_updated, last_accessed = last_updated, size = length(bookmarks);`,
+	`CREATE TABLE history (
+		id           TEXT NOT NULL,
+		revision     INTEGER NOT NULL,
+		bookmarks    TEXT NOT NULL,
+		last_updated TEXT NOT NULL,
+		replaced     TEXT NOT NULL,
+		size         INTEGER NOT NULL,
+		PRIMARY KEY (id, revision)
+	);`,
+	`CREATE TABLE settings (
+		key   TEXT PRIMARY KEY NOT NULL,
+		value TEXT NOT NULL
+	);`,
+	`CREATE TABLE invites (
+		code      TEXT PRIMARY KEY NOT NULL,
+		note      TEXT NOT NULL DEFAULT '',
+		created   TEXT NOT NULL,
+		expires   TEXT NOT NULL DEFAULT '',
+		max_uses  INTEGER NOT NULL DEFAULT 0,
+		uses      INTEGER NOT NULL DEFAULT 0,
+		last_used TEXT NOT NULL DEFAULT ''
+	);`,
+}
+
+// the columns of a sync record, in the order scanSQLiteRecord expects them
+const sqliteRecordColumns = `bookmarks, last_updated, version, created, last_accessed, size`
+
+// likewise for an invite, and scanSQLiteInvite
+const sqliteInviteColumns = `code, note, created, expires, max_uses, uses, last_used`
+
+type sqliteStore struct {
+	db      *sql.DB
+	history HistoryPolicy
+}
+
+// OpenSQLite opens or creates the SQLite database file, migrating it to the current schema if required;
+// readOnly opens the database without the ability to change it (or create it, if it's missing);
+// unlike Bolt, this is happy to run alongside the server
+func OpenSQLite(storageFile string, busyTimeout time.Duration, history HistoryPolicy, readOnly bool) (Store, error) {
+	store, err := openSQLite(storageFile, busyTimeout, history, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// sqliteDSN turns a file name into the URI the driver opens, escaping anything in the name
+// (a '?' or '#', say) that sqlite would otherwise read as the start of the parameters
+func sqliteDSN(storageFile string, params url.Values) string {
+	dsn := url.URL{Scheme: "file", Path: storageFile, RawQuery: params.Encode()}
+	return dsn.String()
+}
+
+func openSQLite(storageFile string, busyTimeout time.Duration, history HistoryPolicy, readOnly bool) (*sqliteStore, error) {
+
+	// pragmas are applied to every connection the pool opens; immediate transactions
+	// take the write lock up front, so concurrent read-then-write transactions queue up
+	// behind the busy timeout rather than failing when they try to upgrade their lock
+	params := url.Values{}
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", busyTimeout.Milliseconds()))
+	if readOnly {
+		params.Set("mode", "ro")
+	} else {
+		params.Add("_pragma", "journal_mode(WAL)")
+		params.Add("_pragma", "synchronous(NORMAL)")
+		params.Set("_txlock", "immediate")
+	}
+
+	db, err := sql.Open("sqlite", sqliteDSN(storageFile, params))
+	if err != nil {
+		return nil, err
+	}
+
+	if readOnly {
+		err = checkSQLiteSchema(db)
+	} else {
+		err = migrateSQLiteSchema(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteStore{db: db, history: history}, nil
+}
+
+// migrateSQLiteSchema brings the database up to the latest schema, in a single transaction
+func migrateSQLiteSchema(db *sql.DB) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var dbVersion int
+	if err = tx.QueryRow(`PRAGMA user_version`).Scan(&dbVersion); err != nil {
+		return err
+	}
+
+	if dbVersion > len(sqliteMigrations) {
+		return fmt.Errorf("database has schema version %d, this build only understands up to %d", dbVersion, len(sqliteMigrations))
+	}
+
+	for ; dbVersion < len(sqliteMigrations); dbVersion++ {
+
+		zLog.Info("Migrating SQLite schema",
+			zap.Int("from", dbVersion),
+			zap.Int("to", dbVersion+1),
+		)
+
+		if _, err = tx.Exec(sqliteMigrations[dbVersion]); err != nil {
+			return fmt.Errorf("migrating to schema version %d: %s", dbVersion+1, err)
+		}
+		if _, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, dbVersion+1)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// checkSQLiteSchema is the read-only counterpart to migrateSQLiteSchema, failing if the
+// database isn't already at the schema version this build expects
+func checkSQLiteSchema(db *sql.DB) error {
+
+	var dbVersion int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&dbVersion); err != nil {
+		return err
+	}
+
+	if dbVersion != len(sqliteMigrations) {
+		return fmt.Errorf("database has schema version %d, this build expects %d; it must be opened read-write (eg. by the server) to migrate it", dbVersion, len(sqliteMigrations))
+	}
+	return nil
+}
+
+// checkSQLiteSnapshot opens a database read-only and makes sure it's intact, and one of ours at a
+// schema version we can migrate from
+func checkSQLiteSnapshot(snapshotFile string) error {
+
+	db, err := sql.Open("sqlite", sqliteDSN(snapshotFile, url.Values{"mode": {"ro"}}))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	if err = db.QueryRow(`PRAGMA quick_check`).Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("database is damaged: %s", result)
+	}
+
+	var dbVersion int
+	if err = db.QueryRow(`PRAGMA user_version`).Scan(&dbVersion); err != nil {
+		return err
+	}
+	if dbVersion == 0 {
+		return errors.New("database has no schema version; not an xSyn database")
+	}
+	if dbVersion > len(sqliteMigrations) {
+		return fmt.Errorf("database has schema version %d, this build only understands up to %d", dbVersion, len(sqliteMigrations))
+	}
+
+	var tables int
+	if err = db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'syncs'`).Scan(&tables); err != nil {
+		return err
+	}
+	if tables == 0 {
+		return errors.New("database has no syncs table; not an xSyn database")
+	}
+	return nil
+}
+
+// read a row of sqliteRecordColumns into a record
+func scanSQLiteRecord(row *sql.Row) (*SyncRecord, error) {
+
+	var record SyncRecord
+	err := row.Scan(
+		&record.Bookmarks,
+		&record.LastUpdated,
+		&record.Version,
+		&record.Created,
+		&record.LastAccessed,
+		&record.Size,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrSyncNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (s *sqliteStore) CreateSync(clientVersion string) (string, string, error) {
+
+	imprintTime := createTimestampString()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	// there's no sequence to hand, so the clock stands in for one
+	// a lookup that fails outright stops the search, rather than being taken for a collision
+	// and retried; the ID it hands back is never used, the error is returned instead
+	var lookupErr error
+	newID, err := generateSyncID(uint64(time.Now().UnixNano()), func(id []byte) bool {
+		var exists int
+		err := tx.QueryRow(`SELECT 1 FROM syncs WHERE id = ?`, string(id)).Scan(&exists)
+		if err != nil && err != sql.ErrNoRows {
+			lookupErr = err
+			return false
+		}
+		return err == nil
+	})
+	if lookupErr != nil {
+		return "", "", lookupErr
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	_, err = tx.Exec(`INSERT INTO syncs (id, last_updated, version, created, last_accessed) VALUES (?, ?, ?, ?, ?)`,
+		newID, imprintTime, clientVersion, imprintTime, imprintTime)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", "", err
+	}
+	return newID, imprintTime, nil
+}
+
+func (s *sqliteStore) Get(id string) (*SyncRecord, error) {
+
+	record, err := s.Peek(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// recording the access is best-effort, it shouldn't fail the read
+	if needsTouch(record.LastAccessed) {
+		_, err = s.db.Exec(`UPDATE syncs SET last_accessed = ? WHERE id = ?`, createTimestampString(), id)
+		if err != nil {
+			zLog.Warn("Failed to update lastAccessed", zap.Error(err))
+		}
+	}
+	return record, nil
+}
+
+func (s *sqliteStore) Peek(id string) (*SyncRecord, error) {
+	return scanSQLiteRecord(s.db.QueryRow(`SELECT `+sqliteRecordColumns+` FROM syncs WHERE id = ?`, id))
+}
+
+// replaceBookmarks moves the record's current bookmarks into the history table, trims that
+// to the history policy, then updates the record with the new bookmarks and timestamp
+func (s *sqliteStore) replaceBookmarks(tx *sql.Tx, id string, record *SyncRecord, bookmarks, imprintTime string) error {
+
+	// a freshly created sync ID has nothing worth keeping
+	if s.history.Revisions > 0 && len(record.Bookmarks) > 0 {
+		_, err := tx.Exec(`INSERT INTO history (id, revision, bookmarks, last_updated, replaced, size)
+			SELECT ?, COALESCE(MAX(revision), 0) + 1, ?, ?, ?, ? FROM history WHERE id = ?`,
+			id, record.Bookmarks, record.LastUpdated, imprintTime, record.Size, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	revisions, err := listSQLiteRevisions(tx, id)
+	if err != nil {
+		return err
+	}
+	if retained := s.history.retained(revisions); retained < len(revisions) {
+		_, err = tx.Exec(`DELETE FROM history WHERE id = ? AND revision <= ?`, id, revisions[retained].Revision)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE syncs SET bookmarks = ?, last_updated = ?, size = ? WHERE id = ?`, bookmarks, imprintTime, len(bookmarks), id)
+	return err
+}
+
+func (s *sqliteStore) PutRecord(id string, record *SyncRecord) error {
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	existing, err := scanSQLiteRecord(tx.QueryRow(`SELECT `+sqliteRecordColumns+` FROM syncs WHERE id = ?`, id))
+	switch err {
+	case ErrSyncNotFound:
+		_, err = tx.Exec(`INSERT INTO syncs (id, `+sqliteRecordColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			id, record.Bookmarks, record.LastUpdated, record.Version, record.Created, record.LastAccessed, len(record.Bookmarks))
+
+	case nil:
+		// archive what's there first, then overwrite the lot
+		if err = s.replaceBookmarks(tx, id, existing, record.Bookmarks, createTimestampString()); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE syncs SET last_updated = ?, version = ?, created = ?, last_accessed = ? WHERE id = ?`,
+			record.LastUpdated, record.Version, record.Created, record.LastAccessed, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// sqlQuerier is the common ground between sql.DB and sql.Tx that we need for reading
+type sqlQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// fetch the revisions of a sync ID, newest first, without their bookmarks data
+func listSQLiteRevisions(q sqlQuerier, id string) ([]SyncRevision, error) {
+
+	rows, err := q.Query(`SELECT revision, last_updated, replaced, size FROM history WHERE id = ? ORDER BY revision DESC`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := make([]SyncRevision, 0)
+	for rows.Next() {
+		var revision SyncRevision
+		if err = rows.Scan(&revision.Revision, &revision.LastUpdated, &revision.Replaced, &revision.Size); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, rows.Err()
+}
+
+func (s *sqliteStore) Put(id, bookmarks, expectedLastUpdated string) (string, error) {
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// only existing syncs can be updated; new ones come through CreateSync
+	record, err := scanSQLiteRecord(tx.QueryRow(`SELECT `+sqliteRecordColumns+` FROM syncs WHERE id = ?`, id))
+	if err != nil {
+		return "", err
+	}
+
+	// as with Bolt, reject the write if another client has synced since this one last looked
+	if len(expectedLastUpdated) > 0 && !TimestampsMatch(record.LastUpdated, expectedLastUpdated) {
+		return "", ErrSyncConflict
+	}
+
+	imprintTime := nextTimestampString(record.LastUpdated)
+
+	if err = s.replaceBookmarks(tx, id, record, bookmarks, imprintTime); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	return imprintTime, nil
+}
+
+func (s *sqliteStore) LastUpdated(id string) (string, error) {
+	record, err := s.Get(id)
+	if err != nil {
+		return "", err
+	}
+	return record.LastUpdated, nil
+}
+
+func (s *sqliteStore) Version(id string) (string, error) {
+
+	var result string
+	err := s.db.QueryRow(`SELECT version FROM syncs WHERE id = ?`, id).Scan(&result)
+	if err == sql.ErrNoRows {
+		return "", ErrSyncNotFound
+	}
+	return result, err
+}
+
+func (s *sqliteStore) Stats() (*Stats, error) {
+
+	var result Stats
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM syncs`).Scan(&result.KeyCount); err != nil {
+		return nil, err
+	}
+
+	// pull a few of the more interesting pragmas for the status page
+	dbStats := make(map[string]interface{})
+	for _, pragma := range []string{"page_count", "page_size", "freelist_count", "journal_mode"} {
+		var value interface{}
+		if err := s.db.QueryRow(fmt.Sprintf(`PRAGMA %s`, pragma)).Scan(&value); err != nil {
+			return nil, err
+		}
+		dbStats[pragma] = value
+	}
+
+	var sqliteVersion string
+	if err := s.db.QueryRow(`SELECT sqlite_version()`).Scan(&sqliteVersion); err != nil {
+		return nil, err
+	}
+	dbStats["sqlite_version"] = sqliteVersion
+
+	if pageCount, ok := dbStats["page_count"].(int64); ok {
+		if pageSize, ok := dbStats["page_size"].(int64); ok {
+			result.SizeBytes = pageCount * pageSize
+		}
+	}
+
+	poolStats := s.db.Stats()
+	result.Details = map[string]interface{}{
+		"SQLite-Db":   dbStats,
+		"SQLite-Pool": structs.Map(poolStats),
+	}
+
+	result.Metrics = map[string]float64{
+		"open_connections":   float64(poolStats.OpenConnections),
+		"in_use_connections": float64(poolStats.InUse),
+		"idle_connections":   float64(poolStats.Idle),
+		"waits_total":        float64(poolStats.WaitCount),
+		"wait_seconds_total": poolStats.WaitDuration.Seconds(),
+	}
+	if freelistCount, ok := dbStats["freelist_count"].(int64); ok {
+		result.Metrics["free_pages"] = float64(freelistCount)
+	}
+	return &result, nil
+}
+
+func (s *sqliteStore) Each(fn func(id string, record *SyncRecord) error) error {
+
+	rows, err := s.db.Query(`SELECT id, ` + sqliteRecordColumns + ` FROM syncs ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var record SyncRecord
+		err = rows.Scan(
+			&id,
+			&record.Bookmarks,
+			&record.LastUpdated,
+			&record.Version,
+			&record.Created,
+			&record.LastAccessed,
+			&record.Size,
+		)
+		if err != nil {
+			return err
+		}
+		if err = fn(id, &record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqliteStore) History(id string) ([]SyncRevision, error) {
+
+	var exists int
+	err := s.db.QueryRow(`SELECT 1 FROM syncs WHERE id = ?`, id).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return nil, ErrSyncNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	revisions, err := listSQLiteRevisions(s.db, id)
+	if err != nil {
+		return nil, err
+	}
+	return revisions[:s.history.retained(revisions)], nil
+}
+
+// fetch a single revision, including its bookmarks, as long as it hasn't expired
+func (s *sqliteStore) getRevision(q sqlQuerier, id string, revision uint64) (*SyncRevision, error) {
+
+	var exists int
+	err := q.QueryRow(`SELECT 1 FROM syncs WHERE id = ?`, id).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return nil, ErrSyncNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := SyncRevision{Revision: revision}
+	err = q.QueryRow(`SELECT bookmarks, last_updated, replaced, size FROM history WHERE id = ? AND revision = ?`, id, revision).
+		Scan(&result.Bookmarks, &result.LastUpdated, &result.Replaced, &result.Size)
+	if err == sql.ErrNoRows {
+		return nil, ErrRevisionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.history.expired(&result) {
+		return nil, ErrRevisionNotFound
+	}
+	return &result, nil
+}
+
+func (s *sqliteStore) Revision(id string, revision uint64) (*SyncRevision, error) {
+	return s.getRevision(s.db, id, revision)
+}
+
+func (s *sqliteStore) RollBack(id string, revision uint64) (string, error) {
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	previous, err := s.getRevision(tx, id, revision)
+	if err != nil {
+		return "", err
+	}
+
+	record, err := scanSQLiteRecord(tx.QueryRow(`SELECT `+sqliteRecordColumns+` FROM syncs WHERE id = ?`, id))
+	if err != nil {
+		return "", err
+	}
+
+	imprintTime := nextTimestampString(record.LastUpdated)
+
+	if err = s.replaceBookmarks(tx, id, record, previous.Bookmarks, imprintTime); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	return imprintTime, nil
+}
+
+func (s *sqliteStore) Delete(id string) error {
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM syncs WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if removed, _ := result.RowsAffected(); removed == 0 {
+		return ErrSyncNotFound
+	}
+
+	if _, err = tx.Exec(`DELETE FROM history WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) DeleteIfInactive(id string, cutoff time.Time) (bool, error) {
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// transactions are immediate, so the write lock is already ours; a client writing to this
+	// sync ID waits (up to the busy timeout) until we're done, and can't change it between
+	// the check below and the delete
+	record, err := scanSQLiteRecord(tx.QueryRow(`SELECT `+sqliteRecordColumns+` FROM syncs WHERE id = ?`, id))
+	if err != nil {
+		return false, err
+	}
+	if !IsInactive(record, cutoff) {
+		return false, nil
+	}
+
+	if _, err = tx.Exec(`DELETE FROM syncs WHERE id = ?`, id); err != nil {
+		return false, err
+	}
+	if _, err = tx.Exec(`DELETE FROM history WHERE id = ?`, id); err != nil {
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *sqliteStore) Backup(w io.Writer) (*SnapshotInfo, error) {
+
+	// VACUUM INTO writes a consistent, compacted copy of the database; it insists on
+	// creating the file itself, so we only borrow a temporary directory to put it in
+	tempDir, err := os.MkdirTemp("", "xsyn-backup")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	snapshotFile := filepath.Join(tempDir, "snapshot.sqlite")
+	if _, err = s.db.Exec(`VACUUM INTO ?`, snapshotFile); err != nil {
+		return nil, err
+	}
+
+	// the live table may have moved on already, so count what actually made it into the snapshot
+	var result SnapshotInfo
+	if result.KeyCount, err = countSQLiteSnapshot(snapshotFile); err != nil {
+		return nil, err
+	}
+
+	snapshot, err := os.Open(snapshotFile)
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Close()
+
+	if result.Size, err = io.Copy(w, snapshot); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// count the sync IDs in a snapshot written by VACUUM INTO
+func countSQLiteSnapshot(snapshotFile string) (int, error) {
+
+	db, err := sql.Open("sqlite", sqliteDSN(snapshotFile, url.Values{"mode": {"ro"}}))
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var keyCount int
+	err = db.QueryRow(`SELECT COUNT(*) FROM syncs`).Scan(&keyCount)
+	return keyCount, err
+}
+
+// CompactSQLite rebuilds the database to reclaim free pages, then folds the WAL back
+// into the main file; other connections are blocked while this runs
+func CompactSQLite(storageFile string, busyTimeout time.Duration) error {
+
+	store, err := openSQLite(storageFile, busyTimeout, HistoryPolicy{}, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if _, err = store.db.Exec(`VACUUM`); err != nil {
+		return err
+	}
+	_, err = store.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`)
+	return err
+}
+
+func (s *sqliteStore) Setting(key string) (string, error) {
+
+	var result string
+	err := s.db.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&result)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return result, err
+}
+
+func (s *sqliteStore) PutSetting(key, value string) error {
+
+	_, err := s.db.Exec(`INSERT INTO settings (key, value) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, value)
+	return err
+}
+
+// read an invite from a row of sqliteInviteColumns
+func scanSQLiteInvite(row interface {
+	Scan(dest ...interface{}) error
+}) (*Invite, error) {
+
+	var invite Invite
+	err := row.Scan(&invite.Code, &invite.Note, &invite.Created, &invite.Expires, &invite.MaxUses, &invite.Uses, &invite.LastUsed)
+	if err == sql.ErrNoRows {
+		return nil, ErrInviteNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+func (s *sqliteStore) CreateInvite(invite *Invite) error {
+
+	result, err := s.db.Exec(`INSERT INTO invites (`+sqliteInviteColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (code) DO NOTHING`,
+		invite.Code, invite.Note, invite.Created, invite.Expires, invite.MaxUses, invite.Uses, invite.LastUsed)
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+		return errInviteExists(invite.Code)
+	}
+	return nil
+}
+
+func (s *sqliteStore) Invites() ([]Invite, error) {
+
+	rows, err := s.db.Query(`SELECT ` + sqliteInviteColumns + ` FROM invites ORDER BY code`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []Invite{}
+	for rows.Next() {
+		invite, err := scanSQLiteInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, *invite)
+	}
+	return invites, rows.Err()
+}
+
+func (s *sqliteStore) UseInvite(code string) (*Invite, error) {
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	invite, err := scanSQLiteInvite(tx.QueryRow(`SELECT `+sqliteInviteColumns+` FROM invites WHERE code = ?`, code))
+	if err != nil {
+		return nil, err
+	}
+	if err = invite.use(); err != nil {
+		return nil, err
+	}
+
+	if _, err = tx.Exec(`UPDATE invites SET uses = ?, last_used = ? WHERE code = ?`, invite.Uses, invite.LastUsed, code); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+func (s *sqliteStore) ReleaseInvite(code string) error {
+
+	result, err := s.db.Exec(`UPDATE invites SET uses = MAX(uses - 1, 0) WHERE code = ?`, code)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+func (s *sqliteStore) DeleteInvite(code string) error {
+
+	result, err := s.db.Exec(`DELETE FROM invites WHERE code = ?`, code)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+func (s *sqliteStore) Backend() string {
+	return "sqlite"
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
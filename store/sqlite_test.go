@@ -0,0 +1,143 @@
+package store
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * the SQLite store, on temporary files so that WAL mode and read-only opens
+ * behave as they do for real
+ *
+ */
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestSQLite(t *testing.T, storageFile string, history HistoryPolicy, readOnly bool) *sqliteStore {
+	t.Helper()
+
+	s, err := openSQLite(storageFile, time.Second, history, readOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSQLiteConformance(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T, history HistoryPolicy) Store {
+		return openTestSQLite(t, filepath.Join(t.TempDir(), "marks.sqlite"), history, false)
+	})
+}
+
+func TestSQLiteAwkwardFileName(t *testing.T) {
+	storageFile := filepath.Join(t.TempDir(), "marks?mode=ro#100%.sqlite")
+
+	s := openTestSQLite(t, storageFile, HistoryPolicy{}, false)
+	if _, _, err := s.CreateSync("1.5.2"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// the name went through whole, rather than being cut short and read as parameters
+	if _, err := os.Stat(storageFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSQLiteSnapshot(storageFile); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the schema version of a database, straight from sqlite
+func sqliteUserVersion(t *testing.T, db *sql.DB) int {
+	t.Helper()
+
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestSQLiteMigrateFromV0(t *testing.T) {
+	storageFile := filepath.Join(t.TempDir(), "marks.sqlite")
+
+	// a database at user_version 0, holding the original syncs table and nothing else
+	db, err := sql.Open("sqlite", storageFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(sqliteMigrations[0] + `
+		INSERT INTO syncs (id, bookmarks, last_updated, version)
+		VALUES ('0123456789abcdef0123456789abcdef', 'old bookmarks', '2019-01-02T03:04:05.678Z', '1.4.0');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := sqliteUserVersion(t, db); version != 0 {
+		t.Fatalf("seeded database is at version %d", version)
+	}
+	db.Close()
+
+	// reading only can't migrate, so it has to refuse
+	if s, err := openSQLite(storageFile, time.Second, HistoryPolicy{}, true); err == nil {
+		s.Close()
+		t.Fatalf("opened an out of date database read-only")
+	}
+
+	s := openTestSQLite(t, storageFile, HistoryPolicy{Revisions: 2}, false)
+	if version := sqliteUserVersion(t, s.db); version != len(sqliteMigrations) {
+		t.Fatalf("migrated to version %d, want %d", version, len(sqliteMigrations))
+	}
+
+	record, err := s.Peek("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Bookmarks != "old bookmarks" || record.Version != "1.4.0" || record.Size != 13 ||
+		record.Created != "2019-01-02T03:04:05.678Z" || record.LastAccessed != record.Created {
+		t.Fatalf("unexpected migrated record %+v", record)
+	}
+
+	// the tables added since are there and working
+	if _, err = s.Put("0123456789abcdef0123456789abcdef", "new bookmarks", record.LastUpdated); err != nil {
+		t.Fatal(err)
+	}
+	if revisions, err := s.History("0123456789abcdef0123456789abcdef"); err != nil || len(revisions) != 1 {
+		t.Fatalf("history after migration: %v, %v", revisions, err)
+	}
+	if err = s.PutSetting("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// opening again has nothing left to do, and now a read-only open is fine too
+	s = openTestSQLite(t, storageFile, HistoryPolicy{}, false)
+	s.Close()
+	readOnly := openTestSQLite(t, storageFile, HistoryPolicy{}, true)
+	if value, err := readOnly.Setting("key"); err != nil || value != "value" {
+		t.Fatalf("setting read-only is %q, %v", value, err)
+	}
+	if err = readOnly.PutSetting("key", "changed"); err == nil {
+		t.Fatalf("wrote to a read-only database")
+	}
+}
+
+func TestSQLiteNewerSchema(t *testing.T) {
+	storageFile := filepath.Join(t.TempDir(), "marks.sqlite")
+
+	db, err := sql.Open("sqlite", storageFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(`PRAGMA user_version = 1000`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if s, err := openSQLite(storageFile, time.Second, HistoryPolicy{}, false); err == nil {
+		s.Close()
+		t.Fatalf("opened a database from a newer build")
+	}
+}
@@ -0,0 +1,330 @@
+package store
+
+/* xSyn, a compact server implementing the xBrowserSync API;
+ *
+ * the route handlers talk to storage through the Store interface defined here,
+ * so that BoltDB is just one of the possible backends; an in-memory store is
+ * also provided, handy for testing handlers without touching disk
+ *
+ * this is its own package so that the server package, and anything embedding
+ * it, can pick a backend and hand it over ready-opened
+ *
+ */
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// zLog is where the backends report migrations and other housekeeping; silent until SetLogger is called
+var zLog = zap.NewNop()
+
+// SetLogger sets the logger used by every store in the package
+func SetLogger(logger *zap.Logger) {
+	zLog = logger
+}
+
+// returned by a Store when a sync ID doesn't exist, or when the client's lastUpdated is stale
+var ErrSyncNotFound = errors.New("sync ID not found")
+var ErrSyncConflict = errors.New("stored lastUpdated does not match client")
+var ErrRevisionNotFound = errors.New("revision not found")
+var ErrNotSupported = errors.New("not supported by this storage backend")
+
+// SyncRecord is everything we hold for a single sync ID; all the timestamps are
+// in the same format as lastUpdated, and Size is the length of the bookmarks data
+type SyncRecord struct {
+	Bookmarks    string `json:"bookmarks"`
+	LastUpdated  string `json:"lastUpdated"`
+	Version      string `json:"version"`
+	Created      string `json:"created"`
+	LastAccessed string `json:"lastAccessed"`
+	Size         int    `json:"size"`
+}
+
+// SyncRevision is a previous version of a sync ID's bookmarks, kept around so that a bad
+// sync can be undone; Replaced is when this revision stopped being the current one
+type SyncRevision struct {
+	Revision    uint64 `json:"revision"`
+	Bookmarks   string `json:"bookmarks,omitempty"`
+	LastUpdated string `json:"lastUpdated"`
+	Replaced    string `json:"replaced"`
+	Size        int    `json:"size"`
+}
+
+// HistoryPolicy controls how many previous revisions a store keeps for each sync ID, and for how
+// long after they were replaced; a zero Revisions count disables history, a zero MaxAge keeps
+// revisions regardless of age
+type HistoryPolicy struct {
+	Revisions int
+	MaxAge    time.Duration
+}
+
+// timeNow is the clock revisions are aged by; a variable so that tests can move it on
+var timeNow = time.Now
+
+// retained returns how many of the given revisions, ordered newest first, should be kept;
+// revisions are only trimmed when a sync ID is written, so this is also applied when they're
+// read, in case MaxAge has passed since
+func (p HistoryPolicy) retained(revisions []SyncRevision) int {
+
+	keep := len(revisions)
+	if keep > p.Revisions {
+		keep = p.Revisions
+	}
+	for i := 0; i < keep; i++ {
+		if p.expired(&revisions[i]) {
+			return i
+		}
+	}
+	return keep
+}
+
+// expired returns true if a revision was replaced longer than MaxAge ago
+func (p HistoryPolicy) expired(revision *SyncRevision) bool {
+	if p.MaxAge <= 0 {
+		return false
+	}
+	replacedTime, err := time.Parse(time.RFC3339Nano, revision.Replaced)
+	return err == nil && timeNow().Sub(replacedTime) > p.MaxAge
+}
+
+// how stale a record's lastAccessed has to be before a read bothers to update it; clients
+// poll lastUpdated every few minutes, and there's no need to rewrite the record each time
+const accessTouchInterval = time.Hour
+
+// needsTouch returns true if lastAccessed is old enough (or broken enough) to be refreshed
+func needsTouch(lastAccessed string) bool {
+	accessedTime, err := time.Parse(time.RFC3339Nano, lastAccessed)
+	return err != nil || time.Since(accessedTime) > accessTouchInterval
+}
+
+// IsInactive returns true if the record hasn't been read or written since the cutoff; if
+// neither timestamp can be understood the record is left well alone
+func IsInactive(record *SyncRecord, cutoff time.Time) bool {
+
+	lastUpdatedTime, errUpdated := time.Parse(time.RFC3339Nano, record.LastUpdated)
+	lastAccessedTime, errAccessed := time.Parse(time.RFC3339Nano, record.LastAccessed)
+
+	switch {
+	case errUpdated != nil && errAccessed != nil:
+		return false
+	case errUpdated != nil:
+		return lastAccessedTime.Before(cutoff)
+	case errAccessed != nil:
+		return lastUpdatedTime.Before(cutoff)
+	}
+	return lastUpdatedTime.Before(cutoff) && lastAccessedTime.Before(cutoff)
+}
+
+// SnapshotInfo describes a snapshot written by Store.Backup
+type SnapshotInfo struct {
+	Size     int64 // bytes written
+	KeyCount int   // sync IDs in the snapshot
+}
+
+// Stats is a summary of the store's contents, shown on the status page;
+// Details holds backend-specific groups of values, keyed by a title for each group,
+// and Metrics the backend-specific numbers worth graphing, named in the Prometheus
+// style; those ending in _total are counters, which only ever go up
+type Stats struct {
+	KeyCount  int
+	SizeBytes int64
+	Details   map[string]interface{}
+	Metrics   map[string]float64
+}
+
+// Store is the storage backend behind the route handlers; implementations
+// must be safe for concurrent use, as Gin runs handlers in parallel
+type Store interface {
+	// CreateSync mints a new, unique sync ID with empty bookmarks data
+	CreateSync(clientVersion string) (id string, lastUpdated string, err error)
+
+	// Get fetches the whole record for a sync ID, noting that it has been accessed
+	Get(id string) (*SyncRecord, error)
+
+	// Peek fetches the whole record for a sync ID without noting the access; for admin tools
+	// that shouldn't keep an abandoned sync ID alive just by looking at it
+	Peek(id string) (*SyncRecord, error)
+
+	// Put replaces the bookmarks for an existing sync ID, returning the new lastUpdated;
+	// if expectedLastUpdated is non-empty and doesn't match the stored value, ErrSyncConflict is returned
+	Put(id, bookmarks, expectedLastUpdated string) (lastUpdated string, err error)
+
+	// PutRecord writes a whole record as-is, creating the sync ID if it doesn't exist; this is for
+	// restoring and importing, so there's no lastUpdated check, but whatever bookmarks it replaces
+	// still go into the history. Size is worked out from the bookmarks rather than trusted
+	PutRecord(id string, record *SyncRecord) error
+
+	// LastUpdated and Version fetch the individual fields of a sync ID; as clients
+	// poll LastUpdated to check for changes, it also counts as an access
+	LastUpdated(id string) (string, error)
+	Version(id string) (string, error)
+
+	// Stats returns a summary of what's stored
+	Stats() (*Stats, error)
+
+	// Each calls fn for every sync ID in the store, stopping at the first error; this doesn't
+	// count as an access, and fn must not modify the store, collect IDs and act on them afterwards
+	Each(fn func(id string, record *SyncRecord) error) error
+
+	// History lists the retained previous revisions of a sync ID, newest first; the
+	// bookmarks data is left out, fetch a single revision with Revision to get that
+	History(id string) ([]SyncRevision, error)
+
+	// Revision fetches a single previous revision, including its bookmarks data
+	Revision(id string, revision uint64) (*SyncRevision, error)
+
+	// RollBack makes a previous revision the current bookmarks again, with a new lastUpdated
+	// so that clients pick it up on their next sync; the bookmarks being replaced go into the
+	// history as usual, so a rollback can itself be undone
+	RollBack(id string, revision uint64) (lastUpdated string, err error)
+
+	// Delete removes a sync ID and all of its data, including history
+	Delete(id string) error
+
+	// DeleteIfInactive is Delete for the pruner; the record is read again in the same transaction
+	// and only removed if IsInactive still holds, so a client syncing in the meantime keeps it.
+	// it returns false, and no error, for a sync ID that has been used since the cutoff
+	DeleteIfInactive(id string, cutoff time.Time) (bool, error)
+
+	// Backup writes a consistent snapshot of the whole store to w, in the backend's own file
+	// format, so that it can be used in place of the live file
+	Backup(w io.Writer) (*SnapshotInfo, error)
+
+	// Setting and PutSetting keep small bits of server state that have to survive a restart,
+	// like whether new syncs are being accepted; Setting returns "" for anything never set
+	Setting(key string) (string, error)
+	PutSetting(key, value string) error
+
+	// CreateInvite stores a new invite code, as made by NewInvite; it fails rather than replace
+	// an invite that already has the same code
+	CreateInvite(invite *Invite) error
+
+	// Invites lists every invite code, including those that have expired or been used up, in code order
+	Invites() ([]Invite, error)
+
+	// UseInvite counts a use of an invite code, returning the invite as updated; if the code can't
+	// be used it fails with ErrInviteNotFound, ErrInviteExpired or ErrInviteUsedUp. the check and
+	// the count happen together, so two people can't both take the last use of a code
+	UseInvite(code string) (*Invite, error)
+
+	// ReleaseInvite hands back a use taken by UseInvite, when the sync ID it was for couldn't be
+	// created after all; LastUsed is left as it is. fails with ErrInviteNotFound if the code has
+	// been deleted in the meantime
+	ReleaseInvite(code string) error
+
+	// DeleteInvite removes an invite code so that it can't be used again; sync IDs already
+	// created with it are left alone
+	DeleteInvite(code string) error
+
+	// Backend names the kind of store, as used in config; "bolt", "sqlite" or "memory"
+	Backend() string
+
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// generateSyncID produces a new 32 character sync ID, mixing a random UUID with the given
+// sequence number; inUse is called to check for collisions, in which case we try again
+func generateSyncID(seqID uint64, inUse func(id []byte) bool) (string, error) {
+
+	// we loop until we generate a unique new ID; although
+	// in the best case this loop will usually only run once as
+	// the UUIDs should be pretty unique
+	buf := make([]byte, 32)
+	uniqueIDRetryCount := 0
+	for {
+
+		// create a UUID from timestamp
+		uuid1, err := uuid.NewV4()
+		if err != nil {
+			return "", err
+		}
+
+		// mix it with the sequence ID
+		uuid2 := uuid.NewV5(uuid1, fmt.Sprintf("%x", seqID))
+
+		// take a slice of the result; xbs wants 32 char ID
+		hex.Encode(buf, uuid2[0:16])
+
+		// used yet? if not, then use it
+		if !inUse(buf) {
+			return string(buf), nil
+		}
+
+		// will loop forever, paranoia suggests we should have
+		// a counter and terminate after N runs
+		uniqueIDRetryCount++
+		zLog.Warn("Duplicate UUID, retrying", zap.Int("Count", uniqueIDRetryCount))
+
+		// .. so do that
+		if uniqueIDRetryCount > 8 {
+			return "", fmt.Errorf("too many UUID collisions")
+		}
+	}
+}
+
+// IsValidSyncID checks for 32 hex characters; both ours and those minted by the official server
+func IsValidSyncID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= '0' && r <= '9') && !(r >= 'a' && r <= 'f') && !(r >= 'A' && r <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// how much of a sync ID to keep when logging it
+const redactedSyncIDLength = 6
+
+// RedactSyncID cuts a sync ID down to its first few characters, for logging; sync IDs are as
+// good as passwords to the bookmarks, but a few characters is enough to follow one through the log
+func RedactSyncID(id string) string {
+	if len(id) <= redactedSyncIDLength {
+		return id
+	}
+	return id[:redactedSyncIDLength] + "..."
+}
+
+// TimestampFormat is how every timestamp is stored, and handed to clients
+const TimestampFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// xbs expects timestamp in "2016-07-06T12:43:16.866Z" format; we keep the milliseconds so
+// that two syncs landing within the same second still produce distinct lastUpdated values
+func createTimestampString() string {
+	return time.Now().UTC().Format(TimestampFormat)
+}
+
+// like createTimestampString, but guaranteed to come after the given previous timestamp
+// for the same sync ID; two writes landing in the same millisecond must still be told
+// apart, otherwise the lastUpdated check on PUT can't spot the second one as a conflict
+func nextTimestampString(previous string) string {
+	now := time.Now().UTC()
+	if previousTime, err := time.Parse(time.RFC3339Nano, previous); err == nil {
+		if earliest := previousTime.Add(time.Millisecond); now.Before(earliest) {
+			now = earliest.UTC()
+		}
+	}
+	return now.Format(TimestampFormat)
+}
+
+// TimestampsMatch compares two lastUpdated strings as points in time, so that a client
+// echoing our timestamp back in a slightly different (but equivalent) format isn't treated
+// as a conflict; anything that won't parse falls back to a plain string comparison
+func TimestampsMatch(stored, client string) bool {
+	storedTime, errStored := time.Parse(time.RFC3339Nano, stored)
+	clientTime, errClient := time.Parse(time.RFC3339Nano, client)
+	if errStored != nil || errClient != nil {
+		return stored == client
+	}
+	return storedTime.Equal(clientTime)
+}